@@ -0,0 +1,150 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// extractArchive extracts the scripts in the tar, gzipped tar or zip file
+// archive into a new temporary directory, whose path it returns.  The caller
+// is responsible for removing the directory.  The format is chosen by the
+// file's extension.  Only regular files and directories are extracted, and
+// an entry whose path would take it outside the directory is an error.
+func extractArchive(archive string) (string, error) {
+	dir, err := ioutil.TempDir("", "script-exporter")
+	if err != nil {
+		return "", err
+	}
+	name := strings.ToLower(archive)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		err = extractZip(archive, dir)
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		err = extractTar(archive, dir, true)
+	case strings.HasSuffix(name, ".tar"):
+		err = extractTar(archive, dir, false)
+	default:
+		err = fmt.Errorf("unknown archive format, expected .tar, .tar.gz, .tgz or .zip")
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// archivePath returns where the archive entry name is to be extracted to
+// under dir, or an error if it's absolute or would escape dir.
+func archivePath(dir, name string) (string, error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("archive entry '%s' has an absolute path", name)
+	}
+	path := filepath.Join(dir, name)
+	if path != dir && !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry '%s' is outside the archive", name)
+	}
+	return path, nil
+}
+
+// extractFile writes the content read from r to path, with permissions mode,
+// creating any missing parent directories.
+func extractFile(path string, mode os.FileMode, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// extractTar extracts the tar file archive, gzipped if compressed, to dir.
+func extractTar(archive, dir string, compressed bool) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if compressed {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path, err := archivePath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(path, os.FileMode(hdr.Mode), tr)
+		default:
+			err = fmt.Errorf("archive entry '%s' isn't a regular file or directory", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// extractZip extracts the zip file archive to dir.
+func extractZip(archive, dir string) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		path, err := archivePath(dir, zf.Name)
+		if err != nil {
+			return err
+		}
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			err = os.MkdirAll(path, 0755)
+		case mode.IsRegular():
+			var rc io.ReadCloser
+			rc, err = zf.Open()
+			if err == nil {
+				err = extractFile(path, mode, rc)
+				rc.Close()
+			}
+		default:
+			err = fmt.Errorf("archive entry '%s' isn't a regular file or directory", zf.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	. "gopkg.in/check.v1"
+)
+
+// archiveEntry is a file to put in a test archive.
+type archiveEntry struct {
+	name, content string
+	mode          int64
+}
+
+func writeTestTar(c *C, filename string, entries []archiveEntry) {
+	f, err := os.Create(filename)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	var w io.Writer = f
+	if path.Ext(filename) == ".tgz" {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		c.Assert(tw.WriteHeader(&tar.Header{Name: e.name, Mode: e.mode, Size: int64(len(e.content)), Typeflag: tar.TypeReg}), IsNil)
+		_, err := tw.Write([]byte(e.content))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(tw.Close(), IsNil)
+}
+
+func writeTestZip(c *C, filename string, entries []archiveEntry) {
+	f, err := os.Create(filename)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name}
+		hdr.SetMode(os.FileMode(e.mode))
+		w, err := zw.CreateHeader(hdr)
+		c.Assert(err, IsNil)
+		_, err = w.Write([]byte(e.content))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(zw.Close(), IsNil)
+}
+
+func (s MySuite) TestExtractArchive(c *C) {
+	tmp, err := ioutil.TempDir("", "script-exporter")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tmp)
+
+	entries := []archiveEntry{
+		{"a", "#!/bin/sh\necho 'a 1'\n", 0755},
+		{"sub/b", "#!/bin/sh\necho 'b 1'\n", 0755},
+		{"README", "scripts\n", 0644},
+	}
+	for _, name := range []string{"scripts.tar", "scripts.tgz", "scripts.zip"} {
+		filename := path.Join(tmp, name)
+		if name == "scripts.zip" {
+			writeTestZip(c, filename, entries)
+		} else {
+			writeTestTar(c, filename, entries)
+		}
+
+		dir, err := extractArchive(filename)
+		c.Assert(err, IsNil, Commentf("%s", name))
+		for _, e := range entries {
+			fi, err := os.Stat(path.Join(dir, e.name))
+			c.Assert(err, IsNil, Commentf("%s", name))
+			c.Check(fi.Mode().Perm(), Equals, os.FileMode(e.mode), Commentf("%s %s", name, e.name))
+			content, err := ioutil.ReadFile(path.Join(dir, e.name))
+			c.Assert(err, IsNil)
+			c.Check(string(content), Equals, e.content)
+		}
+		os.RemoveAll(dir)
+	}
+
+	// Entries escaping the directory are rejected.
+	for _, bad := range []string{"../evil", "sub/../../evil", "/evil"} {
+		filename := path.Join(tmp, "bad.tar")
+		writeTestTar(c, filename, []archiveEntry{{bad, "x", 0644}})
+		_, err := extractArchive(filename)
+		c.Check(err, Not(IsNil), Commentf("%s", bad))
+		filename = path.Join(tmp, "bad.zip")
+		writeTestZip(c, filename, []archiveEntry{{bad, "x", 0644}})
+		_, err = extractArchive(filename)
+		c.Check(err, Not(IsNil), Commentf("%s", bad))
+	}
+	_, err = os.Stat(path.Join(path.Dir(tmp), "evil"))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	_, err = extractArchive(path.Join(tmp, "scripts.rar"))
+	c.Check(err, Not(IsNil))
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// argsData is what the templates in ScriptConfig.Args are rendered with.
+type argsData struct {
+	// Param holds the query parameters of the request, the first value of
+	// each.  It's empty for scheduled runs.
+	Param map[string]string
+
+	// Env holds those environment variables listed in ScriptConfig.ArgsEnv.
+	Env map[string]string
+}
+
+// validParamName matches the query parameter names made available to
+// argument templates.
+var validParamName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// A ParamConfig restricts the values a query parameter may take when it's
+// used to render a script's arguments.  A value is allowed if it's one of
+// Values or matches Regex, which is anchored at both ends.
+type ParamConfig struct {
+	Values []string `yaml:"values"`
+	Regex  string   `yaml:"regex"`
+
+	re *regexp.Regexp
+}
+
+// compile compiles pc's regex, if any.
+func (pc *ParamConfig) compile() error {
+	if pc.Regex == "" {
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + pc.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex '%s': %v", pc.Regex, err)
+	}
+	pc.re = re
+	return nil
+}
+
+// allows returns true if v is an allowed value.
+func (pc *ParamConfig) allows(v string) bool {
+	for _, allowed := range pc.Values {
+		if v == allowed {
+			return true
+		}
+	}
+	return pc.re != nil && pc.re.MatchString(v)
+}
+
+// A paramError is returned by renderArgs when the request has a bad query
+// parameter.
+type paramError struct {
+	msg string
+}
+
+func (e paramError) Error() string {
+	return e.msg
+}
+
+// validHeaderName matches the names of request headers which may be passed to
+// scripts.
+var validHeaderName = regexp.MustCompile(`^[a-zA-Z0-9]+(-[a-zA-Z0-9]+)*$`)
+
+// checkPassHeader returns an error if header can't be listed in
+// ScriptConfig.PassHeaders.  The Proxy header is refused since as
+// HTTP_PROXY it would set the proxy used by many HTTP clients.
+func checkPassHeader(header string) error {
+	if !validHeaderName.MatchString(header) {
+		return fmt.Errorf("invalid header name '%s'", header)
+	}
+	if strings.EqualFold(header, "Proxy") {
+		return fmt.Errorf("header '%s' can't be passed, as HTTP_PROXY would set the script's HTTP proxy", header)
+	}
+	return nil
+}
+
+// headerEnvName returns the name of the environment variable header is passed
+// to scripts in.
+func headerEnvName(header string) string {
+	return "HTTP_" + strings.ToUpper(strings.Replace(header, "-", "_", -1))
+}
+
+// headerEnv returns the environment variables, as "NAME=value", passing those
+// of the headers in header which sc.PassHeaders lists to the script.  A
+// header with several values has them joined by ", ".
+func (sc ScriptConfig) headerEnv(header http.Header) []string {
+	var env []string
+	for _, name := range sc.PassHeaders {
+		if values, ok := header[http.CanonicalHeaderKey(name)]; ok {
+			env = append(env, headerEnvName(name)+"="+strings.Join(values, ", "))
+		}
+	}
+	return env
+}
+
+// requestEnv is the environment variable which describes the scrape a script
+// is run for, as a JSON scriptRequest.
+const requestEnv = "SCRIPT_REQUEST"
+
+// A scriptRequest describes the scrape a script is run for.
+type scriptRequest struct {
+	// ID is the request ID used in the exporter's logs.
+	ID string `json:"id"`
+
+	// Script is the name of the script, and Args the arguments it's run
+	// with.
+	Script string   `json:"script"`
+	Args   []string `json:"args"`
+
+	// Path is the path of the request, and Params its query parameters.
+	Path   string              `json:"path"`
+	Params map[string][]string `json:"params"`
+
+	// Headers holds those request headers listed in the script's
+	// pass_headers.
+	Headers map[string][]string `json:"headers"`
+
+	// Deadline is when the script will be timed out, in RFC 3339 format.
+	Deadline string `json:"deadline"`
+}
+
+// requestEnvVar returns the environment variable, as "NAME=value", describing
+// the request r which script is run with args for.
+func (sc ScriptConfig) requestEnvVar(r *http.Request, id, script string, args []string, deadline time.Time) (string, error) {
+	req := scriptRequest{
+		ID:       id,
+		Script:   script,
+		Args:     args,
+		Path:     r.URL.Path,
+		Params:   r.URL.Query(),
+		Headers:  make(map[string][]string),
+		Deadline: deadline.UTC().Format(time.RFC3339Nano),
+	}
+	if req.Args == nil {
+		req.Args = []string{}
+	}
+	for _, name := range sc.PassHeaders {
+		if values, ok := r.Header[http.CanonicalHeaderKey(name)]; ok {
+			req.Headers[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	return requestEnv + "=" + string(b), nil
+}
+
+// parseArgTemplate parses a template given in ScriptConfig.Args.
+func parseArgTemplate(arg string) (*template.Template, error) {
+	return template.New("arg").Option("missingkey=error").Parse(arg)
+}
+
+// renderArgs returns the script arguments given by sc.Args, rendering each
+// as a template with the parameters in query and the environment variables
+// listed in sc.ArgsEnv.  A query parameter value which sc.Params doesn't
+// allow, or which contains control characters or invalid UTF-8, is a
+// paramError.  A template referring to a parameter or variable that isn't
+// set is also an error.
+func (sc ScriptConfig) renderArgs(query url.Values) ([]string, error) {
+	for name, pc := range sc.Params {
+		for _, v := range query[name] {
+			if !pc.allows(v) {
+				return nil, paramError{fmt.Sprintf("value %q not allowed for query parameter '%s'", v, name)}
+			}
+		}
+	}
+	if len(sc.Args) == 0 {
+		return nil, nil
+	}
+
+	data := argsData{Param: make(map[string]string), Env: make(map[string]string)}
+	for name, values := range query {
+		if !validParamName.MatchString(name) || len(values) == 0 {
+			continue
+		}
+		v := values[0]
+		if !utf8.ValidString(v) || strings.IndexFunc(v, unicode.IsControl) >= 0 {
+			return nil, paramError{fmt.Sprintf("query parameter '%s' contains control characters or invalid UTF-8", name)}
+		}
+		data.Param[name] = v
+	}
+	for _, name := range sc.ArgsEnv {
+		if v, ok := os.LookupEnv(name); ok {
+			data.Env[name] = v
+		}
+	}
+
+	args := make([]string, 0, len(sc.Args))
+	for _, arg := range sc.Args {
+		tmpl, err := parseArgTemplate(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid argument template '%s': %v", arg, err)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("unable to render argument template '%s': %v", arg, err)
+		}
+		args = append(args, buf.String())
+	}
+	return args, nil
+}
+
+// argsFileSuffix is appended to the path of a script to give the path of its
+// args file, listing arguments to pass it before any others.
+const argsFileSuffix = ".args"
+
+// cachedArgs holds the arguments read from an args file, along with the
+// modification time and size it had.
+type cachedArgs struct {
+	modTime time.Time
+	size    int64
+	args    []string
+}
+
+// fileArgs returns the arguments listed in the args file filename, one per
+// line with surrounding whitespace trimmed; blank lines and lines starting
+// with # are ignored.  If there's no such file there are no arguments.  The
+// file is only read again once its modification time or size changes.
+func (sh *ScriptHandler) fileArgs(filename string) ([]string, error) {
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, spawnError{fmt.Errorf("unable to read args file: %v", err)}
+	}
+
+	sh.mtx.RLock()
+	cached, ok := sh.argsFiles[filename]
+	sh.mtx.RUnlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.args, nil
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, spawnError{fmt.Errorf("unable to read args file: %v", err)}
+	}
+	var args []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			args = append(args, line)
+		}
+	}
+	sh.mtx.Lock()
+	sh.argsFiles[filename] = cachedArgs{modTime: info.ModTime(), size: info.Size(), args: args}
+	sh.mtx.Unlock()
+	return args, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s MySuite) TestRenderArgs(c *C) {
+	os.Setenv("SCRIPT_EXPORTER_TEST_REGION", "eu")
+	os.Setenv("SCRIPT_EXPORTER_TEST_SECRET", "hunter2")
+	defer os.Unsetenv("SCRIPT_EXPORTER_TEST_REGION")
+	defer os.Unsetenv("SCRIPT_EXPORTER_TEST_SECRET")
+
+	sc := ScriptConfig{
+		Args:    []string{"--target={{.Param.target}}", "{{.Env.SCRIPT_EXPORTER_TEST_REGION}}", "plain"},
+		ArgsEnv: []string{"SCRIPT_EXPORTER_TEST_REGION"},
+	}
+	args, err := sc.renderArgs(url.Values{"target": {"db1", "db2"}, "other": {"x"}})
+	c.Assert(err, IsNil)
+	c.Check(args, DeepEquals, []string{"--target=db1", "eu", "plain"})
+
+	// Missing parameters are an error.
+	_, err = sc.renderArgs(nil)
+	c.Check(err, Not(IsNil))
+
+	// As are parameter values containing control characters.
+	_, err = sc.renderArgs(url.Values{"target": {"db1\n--evil"}})
+	c.Check(err, Not(IsNil))
+
+	// Only listed environment variables are available.
+	sc = ScriptConfig{Args: []string{"{{.Env.SCRIPT_EXPORTER_TEST_SECRET}}"}}
+	_, err = sc.renderArgs(nil)
+	c.Check(err, Not(IsNil))
+
+	args, err = ScriptConfig{}.renderArgs(url.Values{"target": {"db1"}})
+	c.Assert(err, IsNil)
+	c.Check(args, HasLen, 0)
+}
+
+func (s MySuite) TestRenderArgsParams(c *C) {
+	sc := ScriptConfig{
+		Args: []string{"{{.Param.target}}"},
+		Params: map[string]*ParamConfig{
+			"target": {Values: []string{"localhost"}, Regex: `db[0-9]+`},
+		},
+	}
+	c.Assert(sc.Params["target"].compile(), IsNil)
+
+	for _, target := range []string{"localhost", "db1", "db22"} {
+		args, err := sc.renderArgs(url.Values{"target": {target}})
+		c.Assert(err, IsNil)
+		c.Check(args, DeepEquals, []string{target})
+	}
+	for _, target := range []string{"db", "xdb1", "db1x", "local"} {
+		_, err := sc.renderArgs(url.Values{"target": {target}})
+		c.Check(err, FitsTypeOf, paramError{}, Commentf("%s", target))
+	}
+
+	// Every value of a repeated parameter is checked.
+	_, err := sc.renderArgs(url.Values{"target": {"db1", "evil"}})
+	c.Check(err, FitsTypeOf, paramError{})
+}
+
+func (s MySuite) TestHeaderEnv(c *C) {
+	sc := ScriptConfig{PassHeaders: []string{"x-tenant-id", "X-Region", "X-Missing"}}
+	header := http.Header{}
+	header.Set("X-Tenant-ID", "acme")
+	header.Add("X-Region", "eu")
+	header.Add("X-Region", "us")
+	header.Set("Authorization", "Bearer secret")
+	c.Check(sc.headerEnv(header), DeepEquals, []string{"HTTP_X_TENANT_ID=acme", "HTTP_X_REGION=eu, us"})
+	c.Check(ScriptConfig{}.headerEnv(header), HasLen, 0)
+
+	c.Check(checkPassHeader("X-Tenant-ID"), IsNil)
+	for _, bad := range []string{"", "X_Tenant", "X-", "Proxy", "proxy"} {
+		c.Check(checkPassHeader(bad), Not(IsNil), Commentf("%s", bad))
+	}
+}
+
+func (s MySuite) TestRequestEnvVar(c *C) {
+	r, err := http.NewRequest("GET", "/metrics/probe?target=db1&target=db2", nil)
+	c.Assert(err, IsNil)
+	r.Header.Set("X-Tenant-ID", "acme")
+	r.Header.Set("Authorization", "Bearer secret")
+	deadline := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	sc := ScriptConfig{PassHeaders: []string{"x-tenant-id"}}
+	v, err := sc.requestEnvVar(r, "abcd1234", "probe", []string{"--target=db1"}, deadline)
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(v, "SCRIPT_REQUEST="), Equals, true)
+
+	var req scriptRequest
+	c.Assert(json.Unmarshal([]byte(strings.TrimPrefix(v, "SCRIPT_REQUEST=")), &req), IsNil)
+	c.Check(req, DeepEquals, scriptRequest{
+		ID:       "abcd1234",
+		Script:   "probe",
+		Args:     []string{"--target=db1"},
+		Path:     "/metrics/probe",
+		Params:   map[string][]string{"target": {"db1", "db2"}},
+		Headers:  map[string][]string{"X-Tenant-Id": {"acme"}},
+		Deadline: "2019-01-02T03:04:05Z",
+	})
+}
+
+func (s MySuite) TestArgsFile(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"sidecar": "#!/bin/sh\necho \"args{a=\\\"$*\\\"} $#\"\n",
+	})
+	defer os.RemoveAll(dir)
+	argsFile := path.Join(dir, "sidecar"+argsFileSuffix)
+	c.Assert(ioutil.WriteFile(argsFile, []byte("# defaults\n--verbose\n\n  --port=80  \n"), 0644), IsNil)
+
+	config := &Config{Scripts: map[string]ScriptConfig{
+		"sidecar": {Args: []string{"--port={{.Param.port}}"}},
+	}}
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{}, config)
+	go sh.Start()
+
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/sidecar?port=8080", nil))
+		c.Check(w.Code, Equals, 200)
+		return w.Body.String()
+	}
+	// The args file's arguments come first, so that those from the request
+	// follow and take precedence for scripts where the last option wins.
+	c.Check(scrape(), Matches, `(?s).*args{a="--verbose --port=80 --port=8080"} 3\n.*`)
+
+	// A changed args file is read again.
+	c.Assert(ioutil.WriteFile(argsFile, []byte("--quiet\n"), 0644), IsNil)
+	c.Check(scrape(), Matches, `(?s).*args{a="--quiet --port=8080"} 2\n.*`)
+
+	c.Assert(os.Remove(argsFile), IsNil)
+	c.Check(scrape(), Matches, `(?s).*args{a="--port=8080"} 1\n.*`)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// maxCooldownFactor limits how many times its configured cooldown a script's
+// circuit breaker stays open for, however many trial runs in a row fail.
+const maxCooldownFactor = 32
+
+// defaultCooldown is the cooldown of circuit breakers which don't configure
+// one.
+const defaultCooldown = time.Minute
+
+// A breaker tracks the consecutive failures of a script.  Once there have
+// been enough, its circuit opens: requests to run the script get the result
+// of its latest failure rather than running it, until the cooldown has
+// passed.  The next request then runs the script as a trial.  If the trial
+// fails the circuit opens again for twice as long, otherwise it closes.
+type breaker struct {
+	// failures counts consecutive failed runs.
+	failures int
+
+	// last is the result of the latest failed run.
+	last runresult
+
+	// cooldown is how long the circuit is open for, and openUntil when it
+	// next closes.
+	cooldown  time.Duration
+	openUntil time.Time
+
+	// trial is true while a trial run is in progress.
+	trial bool
+}
+
+// circuitOpen returns the result to use for a request to run script rather
+// than running it, and true, if script's circuit breaker is open.  Otherwise
+// the script should be run and its result passed to recordCircuit.
+func (sh *ScriptHandler) circuitOpen(script string, sc ScriptConfig) (runresult, bool) {
+	if sc.CircuitBreakerFailures <= 0 {
+		return runresult{}, false
+	}
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+	b, ok := sh.breakers[script]
+	if !ok || b.failures < sc.CircuitBreakerFailures {
+		return runresult{}, false
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		mCircuitOpen.WithLabelValues(script).Inc()
+		return b.last, true
+	}
+	b.trial = true
+	return runresult{}, false
+}
+
+// recordCircuit updates script's circuit breaker with the result of running
+// it.  Runs rejected for exceeding the concurrency limit or because the script
+// is disabled, and runs canceled by the requester, don't count.
+func (sh *ScriptHandler) recordCircuit(id, script string, sc ScriptConfig, result runresult) {
+	if sc.CircuitBreakerFailures <= 0 {
+		return
+	}
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+	b, ok := sh.breakers[script]
+	_, rejected := result.err.(concurrencyError)
+	if _, disabled := result.err.(disabledError); rejected || disabled || result.err == context.Canceled {
+		if ok {
+			b.trial = false
+		}
+		return
+	}
+	if result.err == nil {
+		if ok && b.failures >= sc.CircuitBreakerFailures {
+			infof("[%s] script '%s' succeeded, closing its circuit breaker", id, script)
+		}
+		delete(sh.breakers, script)
+		return
+	}
+
+	if !ok {
+		b = &breaker{}
+		sh.breakers[script] = b
+	}
+	b.failures++
+	b.last = result
+	cooldown := sc.CircuitBreakerCooldown
+	if cooldown <= 0 {
+		cooldown = defaultCooldown
+	}
+	switch {
+	case b.trial:
+		b.trial = false
+		b.cooldown *= 2
+		if max := cooldown * maxCooldownFactor; b.cooldown > max {
+			b.cooldown = max
+		}
+	case b.failures == sc.CircuitBreakerFailures:
+		b.cooldown = cooldown
+	default:
+		return
+	}
+	b.openUntil = time.Now().Add(b.cooldown)
+	warnf("[%s] script '%s' has failed %d times in a row, not running it for %v", id, script, b.failures, b.cooldown)
+}
@@ -1,64 +1,301 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
+// commandOpts controls how runCommand invokes a script.
+type commandOpts struct {
+	// dir is the working directory of the script; if empty, the exporter's
+	// working directory is used.
+	dir string
+
+	// user and group to run the script as, given as names or numeric IDs.
+	// If both are empty the script runs as the same user we do.
+	user, group string
+
+	// killGracePeriod is how long to wait after sending SIGTERM to the
+	// script when ctx is done, before sending SIGKILL.  If zero, SIGKILL is
+	// sent immediately.
+	killGracePeriod time.Duration
+
+	// hardTimeout, if nonzero, is how long after the script started it's
+	// sent SIGKILL once ctx is done, in place of killGracePeriod.
+	hardTimeout time.Duration
+
+	// If stderr is non-nil, everything the script writes to stderr is
+	// copied to it.
+	stderr io.Writer
+
+	// successCodes lists nonzero exit statuses which are to be treated as
+	// success rather than as an error.
+	successCodes []int
+
+	// If allowStderr is true, the script writing to stderr isn't an error.
+	allowStderr bool
+
+	// If stderrLine is non-nil, it's called with each line the script writes
+	// to stderr as soon as the line is complete.
+	stderrLine func(line string)
+
+	// nice, if nonzero, is the niceness to run the script with.  If ioClass
+	// is nonempty, the script's I/O scheduling class is set to it, with
+	// priority ioPriority within the class.
+	nice       int
+	ioClass    string
+	ioPriority int
+
+	// limits are the resource limits to run the script with.
+	limits rlimits
+
+	// env lists extra environment variables to give the script, as
+	// "NAME=value".
+	env []string
+
+	// If stdin is non-nil, the script reads its standard input from it.
+	stdin io.Reader
+}
+
+// rlimits are resource limits for a script: the bytes of address space it
+// may use, the number of files it may have open, and the CPU time it may
+// use.  Zero fields mean no limit.
+type rlimits struct {
+	memory, files uint64
+	cpu           time.Duration
+}
+
+// cpuSeconds returns the CPU time limit in whole seconds, rounded up.
+func (l rlimits) cpuSeconds() uint64 {
+	return uint64((l.cpu + time.Second - 1) / time.Second)
+}
+
+// A stderrError is returned by runCommand when a script exits successfully
+// but writes to stderr, unless opts.allowStderr is set.
+type stderrError struct {
+	stderr string
+}
+
+func (e stderrError) Error() string {
+	return fmt.Sprintf("got stderr output: %v", e.stderr)
+}
+
+// A spawnError is returned by runCommand when the script couldn't be started
+// at all, e.g. because it doesn't exist or isn't executable.
+type spawnError struct {
+	err error
+}
+
+func (e spawnError) Error() string {
+	return e.err.Error()
+}
+
+// An exitError is returned by runCommand when a script exits with a nonzero
+// status not listed in opts.successCodes, or is killed by a signal.
+type exitError struct {
+	*exec.ExitError
+}
+
+// A limitError is returned by runCommand when a script is killed for
+// exceeding its CPU time limit.  Exceeding the memory or open file limits
+// makes allocations or opening files fail within the script, which then
+// fails in its own way.
+type limitError struct {
+	exitError
+	cpu time.Duration
+}
+
+func (e limitError) Error() string {
+	return fmt.Sprintf("exceeded cpu_limit of %v", e.cpu)
+}
+
+// A timeoutError is returned by runCommand when a script is stopped because
+// ctx's deadline passed.
+type timeoutError struct{}
+
+func (timeoutError) Error() string {
+	return "timed out"
+}
+
+// A filterError is returned when a script's filter_command fails.
+type filterError struct {
+	err error
+}
+
+func (e filterError) Error() string {
+	return "filter command: " + e.err.Error()
+}
+
+// exitCode returns the exit status of the script for which runCommand
+// returned err, or -1 if it didn't exit normally.
+func exitCode(err error) int {
+	switch e := err.(type) {
+	case nil, stderrError:
+		return 0
+	case exitError:
+		return e.ExitCode()
+	case limitError:
+		return e.ExitCode()
+	}
+	return -1
+}
+
+// stopProcessGroup terminates cmd and any children it has spawned, then
+// waits for cmd to exit.  If grace is nonzero the process group is first
+// sent SIGTERM, and only sent SIGKILL if cmd is still running after grace
+// has elapsed.  Any stragglers left in the group once cmd has exited are
+// killed as well.
+func stopProcessGroup(cmd *exec.Cmd, grace time.Duration) {
+	waitdone := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(waitdone)
+	}()
+
+	if grace > 0 {
+		terminateProcessGroup(cmd)
+		select {
+		case <-waitdone:
+		case <-time.After(grace):
+		}
+	}
+	killProcessGroup(cmd)
+	<-waitdone
+}
+
+// stdoutDrainTimeout is how long runCommand waits for a script's stdout to be
+// closed once the script has been stopped on timeout.
+const stdoutDrainTimeout = time.Second
+
+// timeoutEnv is the environment variable which tells a script how many
+// seconds it has left before it will be killed.
+const timeoutEnv = "SCRIPT_TIMEOUT_SECONDS"
+
 // runCommand invokes script under sh.scriptPath, returning its stdout and
-// any error that resulted.  Errors include the script exiting with nonzero
-// status or via signal, the script writing to stderr, or the context
-// reaching Done state.  In the latter case the error will be one of
-// context.Canceled or context.DeadlineExceeded.
-func runCommand(ctx context.Context, script string, args ...string) (string, error) {
-	// Create a new context for the command so that we don't fight over
-	// the Done() message.
-	cmdctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-	cmd := exec.CommandContext(cmdctx, script, args...)
+// any error that resulted: a spawnError if it couldn't be started, an
+// exitError if it exited with nonzero status not listed in opts.successCodes
+// or via signal, a stderrError if it wrote to stderr, a timeoutError if ctx's
+// deadline passed, or context.Canceled if ctx was canceled.  If ctx has a
+// deadline, the time remaining until it is passed to the script in
+// $SCRIPT_TIMEOUT_SECONDS.
+func runCommand(ctx context.Context, opts commandOpts, script string, args ...string) (string, error) {
+	// A relative script path would be resolved relative to opts.dir by
+	// exec, but we want it relative to our own working directory.
+	if opts.dir != "" && !filepath.IsAbs(script) && filepath.Base(script) != script {
+		abs, err := filepath.Abs(script)
+		if err != nil {
+			return "", fmt.Errorf("unable to resolve script path: %v", err)
+		}
+		script = abs
+	}
+
+	// We don't use exec.CommandContext because it only knows how to SIGKILL
+	// the child, whereas we want to give it and any children it has spawned
+	// a chance to clean up.  So the child is put in its own process group,
+	// which we signal ourselves once ctx is done.
+	cmd := exec.Command(script, args...)
+	cmd.Dir = opts.dir
+	cmd.Stdin = opts.stdin
+	cmd.Env = append(os.Environ(), opts.env...)
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := strconv.FormatFloat(time.Until(deadline).Seconds(), 'f', 3, 64)
+		cmd.Env = append(cmd.Env, timeoutEnv+"="+remaining)
+	}
+	setProcessGroup(cmd)
+	if err := setCredential(cmd, opts.user, opts.group); err != nil {
+		return "", spawnError{fmt.Errorf("unable to set credentials: %v", err)}
+	}
+	execStatus, err := limitCommand(cmd, opts.limits)
+	if err != nil {
+		return "", spawnError{err}
+	}
 
 	// It'd be simpler to use cmd.Output(), which was what I tried first.
 	// The problem is that due to https://github.com/golang/go/issues/18874
 	// we then may fail to promptly timeout children that spawn their own
-	// child processes.
+	// child processes: Output() doesn't return until every process holding
+	// the pipes open has exited.  Signalling the whole process group takes
+	// care of the grandchildren themselves, so none are left orphaned.
 
-	var pstdout, pstderr io.ReadCloser
-	var err error
-	pstdout, err = cmd.StdoutPipe()
+	// Stdout is read through a pipe of our own rather than StdoutPipe,
+	// because Wait closes the latter as soon as the script exits, losing
+	// anything it wrote on its way out after SIGTERM.
+	var pstderr io.ReadCloser
+	pstdout, wstdout, err := os.Pipe()
 	if err != nil {
-		return "", fmt.Errorf("unable to create stdout pipe: %v", err)
+		return "", spawnError{fmt.Errorf("unable to create stdout pipe: %v", err)}
 	}
-	defer func(rc io.ReadCloser) {
-		rc.Close()
-	}(pstdout)
+	defer pstdout.Close()
+	defer wstdout.Close()
+	cmd.Stdout = wstdout
 
 	pstderr, err = cmd.StderrPipe()
 	if err != nil {
-		return "", fmt.Errorf("unable to create stderr pipe: %v", err)
+		return "", spawnError{fmt.Errorf("unable to create stderr pipe: %v", err)}
 	}
 	defer func(rc io.ReadCloser) {
 		rc.Close()
 	}(pstderr)
 
+	start := time.Now()
 	err = cmd.Start()
+	wstdout.Close()
+	if execStatus != nil {
+		if serr := execStatus(); err == nil && serr != nil {
+			cmd.Wait()
+			err = serr
+		}
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to start child: %v", err)
+		return "", spawnError{fmt.Errorf("failed to start child: %v", err)}
+	}
+	// There's no way to have exec set the priority before the script
+	// starts, so it runs at ours very briefly.  Setting it on the process
+	// group takes care of any children it has spawned in the meantime.
+	if err := setPriority(cmd.Process.Pid, opts.nice, opts.ioClass, opts.ioPriority); err != nil {
+		stopProcessGroup(cmd, 0)
+		return "", spawnError{err}
 	}
 
 	var stdout, stderr bytes.Buffer
 	chdone := make(chan struct{}, 2)
 
 	// These goroutines shouldn't leak because once Wait() returns, Copy()
-	// inputs will be closed and thus the goroutines will return.
+	// inputs will be closed and thus the goroutines will return.  In case
+	// they do, they're counted in and out by metrics.
+	mCopiesStarted.Add(2)
 	go func() {
 		io.Copy(&stdout, pstdout)
+		mCopiesFinished.Inc()
 		chdone <- struct{}{}
 	}()
 	go func() {
-		io.Copy(&stderr, pstderr)
+		var w io.Writer = &stderr
+		if opts.stderr != nil {
+			w = io.MultiWriter(&stderr, opts.stderr)
+		}
+		if opts.stderrLine != nil {
+			tee := io.TeeReader(pstderr, w)
+			scanner := bufio.NewScanner(tee)
+			for scanner.Scan() {
+				opts.stderrLine(scanner.Text())
+			}
+			// If the scanner gave up, e.g. on an overlong line, keep
+			// copying to w.
+			io.Copy(ioutil.Discard, tee)
+		} else {
+			io.Copy(w, pstderr)
+		}
+		mCopiesFinished.Inc()
 		chdone <- struct{}{}
 	}()
 
@@ -72,12 +309,68 @@ func runCommand(ctx context.Context, script string, args ...string) (string, err
 			closed++
 		}
 	}
-	err = cmd.Wait()
 	if ctxdone {
+		grace := opts.killGracePeriod
+		if opts.hardTimeout > 0 {
+			grace = opts.hardTimeout - time.Since(start)
+			if grace < 0 {
+				grace = 0
+			}
+		}
+		stopProcessGroup(cmd, grace)
+		// The process group is gone and Wait has closed the stderr pipe,
+		// so the copying goroutines will finish promptly unless a child
+		// escaped the group with stdout open; wait for them so we don't
+		// race on the buffers.
+		for ; closed < 2; closed++ {
+			select {
+			case <-chdone:
+			case <-time.After(stdoutDrainTimeout):
+				pstdout.Close()
+				<-chdone
+			}
+		}
 		err = ctx.Err()
+		if err == context.DeadlineExceeded {
+			err = timeoutError{}
+		}
+	} else {
+		err = cmd.Wait()
+		if ee, ok := err.(*exec.ExitError); ok {
+			err = exitError{ee}
+			if opts.limits.cpu > 0 && cpuLimitExceeded(ee) {
+				err = limitError{exitError{ee}, opts.limits.cpu}
+			}
+			for _, code := range opts.successCodes {
+				if ee.ExitCode() == code {
+					err = nil
+					break
+				}
+			}
+		}
 	}
-	if err == nil && stderr.Len() != 0 {
-		err = fmt.Errorf("got stderr output: %v", stderr.String())
+	if err == nil && stderr.Len() != 0 && !opts.allowStderr {
+		err = stderrError{stderr.String()}
 	}
 	return stdout.String(), err
 }
+
+// readOutputFile returns the contents of filename, which a script run at
+// start was to write its metrics to.  The file not existing, or not having
+// been modified since start, is an error.
+func readOutputFile(filename string, start time.Time) (string, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return "", fmt.Errorf("script didn't produce output file: %v", err)
+	}
+	// Allow for filesystems that only record modification times to the
+	// second.
+	if info.ModTime().Before(start.Truncate(time.Second)) {
+		return "", fmt.Errorf("script didn't update output file '%s'", filename)
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("unable to read output file: %v", err)
+	}
+	return string(content), nil
+}
@@ -2,18 +2,24 @@ package main
 
 import (
 	// "github.com/kylelemons/godebug/pretty"
+	"bosun.org/opentsdb"
+	"bytes"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	. "gopkg.in/check.v1"
+	"net/http/httptest"
+	"os"
 	"sort"
+	"strings"
 	"time"
 )
 
 func (s MySuite) TestTranslateOpentsdb(c *C) {
 	now := time.Now().Unix()
 	ot := fmt.Sprintf("a.a %d 9 l1=v1\na.b %d 99 l2=v2 l3=v3", now, now+1)
-	pms, err := translateOpenTsdb(ot)
+	pms, err := translateOpenTsdb(ot, parseOpts{})
 	c.Assert(err, IsNil)
 	c.Assert(len(pms), Equals, 2)
 
@@ -45,3 +51,471 @@ func (s MySuite) TestTranslateOpentsdb(c *C) {
 	c.Check(met2.Label[1].GetName(), Equals, "l3")
 	c.Check(met2.Label[1].GetValue(), Equals, "v3")
 }
+
+func (s MySuite) TestSanitizeLabelValue(c *C) {
+	for _, tc := range []struct {
+		lvs         labelValueSanitizer
+		in, want    string
+		expectError bool
+	}{
+		{sanitizeEscape, `a "b" c.d`, `a "b" c.d`, false},
+		{sanitizeEscape, "a\tb\nc\x01", `a\tb\nc\x01`, false},
+		{sanitizeEscape, "a\xffb", `a\xffb`, false},
+		{sanitizeStrip, "a\tb\nc\x01", "abc", false},
+		{sanitizeStrip, "a\xffb", "ab", false},
+		{sanitizeReject, `a "b" c.d`, `a "b" c.d`, false},
+		{sanitizeReject, "a\tb", "", true},
+		{sanitizeReject, "a\xffb", "", true},
+	} {
+		got, err := tc.lvs.sanitize(tc.in)
+		if tc.expectError {
+			c.Check(err, Not(IsNil), Commentf("%s %q", tc.lvs, tc.in))
+		} else {
+			c.Check(err, IsNil, Commentf("%s %q", tc.lvs, tc.in))
+			c.Check(got, Equals, tc.want, Commentf("%s %q", tc.lvs, tc.in))
+		}
+	}
+}
+
+func (s MySuite) TestTranslateOpentsdbTags(c *C) {
+	// Tag keys are made into valid label names, and quotes in values are fine.
+	pms, err := translateOpenTsdb(`a.a 0 1 k.1=v.1 k"2=v"2`, parseOpts{})
+	c.Assert(err, IsNil)
+	c.Assert(len(pms), Equals, 1)
+	c.Check(pms[0].Desc().String(), Equals, `Desc{fqName: "a_a", help: "help", constLabels: {k_1="v.1",k_2="v\"2"}, variableLabels: []}`)
+
+	// Spaces can't appear in a tag read from text, but can in a data point.
+	dp := opentsdb.DataPoint{Metric: "a", Value: 1.0, Tags: opentsdb.TagSet{"k 1": "v 1\t"}}
+	pms, err = dpointsToMetrics([]opentsdb.DataPoint{dp}, nil, parseOpts{labelValues: sanitizeStrip})
+	c.Assert(err, IsNil)
+	c.Check(pms[0].Desc().String(), Equals, `Desc{fqName: "a", help: "help", constLabels: {k_1="v 1"}, variableLabels: []}`)
+	_, err = dpointsToMetrics([]opentsdb.DataPoint{dp}, nil, parseOpts{labelValues: sanitizeReject})
+	c.Check(err, Not(IsNil))
+
+	_, err = translateOpenTsdb("a 0 1 k=", parseOpts{})
+	c.Check(err, Not(IsNil))
+	_, err = translateOpenTsdb("a 0 1 k=v k=w", parseOpts{})
+	c.Check(err, Not(IsNil))
+}
+
+func (s MySuite) TestMetricPrefix(c *C) {
+	text := `# TYPE a_total counter
+a_total 1
+# TYPE b summary
+b{quantile="0.5"} 2
+b_sum 3
+b_count 4
+# TYPE c histogram
+c_bucket{le="+Inf"} 5
+c_sum 6
+c_count 5
+`
+	w := httptest.NewRecorder()
+	stats, err := serveMetricsFromText(parseOpts{prefix: "disk_"}, w, httptest.NewRequest("GET", "/", nil), text)
+	c.Assert(err, IsNil)
+	c.Check(stats.timeseries, Equals, 3)
+	c.Check(stats.oldest.IsZero(), Equals, true)
+	body := w.Body.String()
+	for _, line := range []string{
+		"disk_a_total 1",
+		`disk_b{quantile="0.5"} 2`,
+		"disk_b_sum 3",
+		"disk_b_count 4",
+		`disk_c_bucket{le="+Inf"} 5`,
+		"disk_c_sum 6",
+		"disk_c_count 5",
+	} {
+		c.Check(strings.Contains(body, line+"\n"), Equals, true, Commentf("missing %q in %s", line, body))
+	}
+
+	pms, err := translateOpenTsdb("a.a 0 1", parseOpts{prefix: "disk_"})
+	c.Assert(err, IsNil)
+	c.Check(pms[0].Desc().String(), Equals, `Desc{fqName: "disk_a_a", help: "help", constLabels: {}, variableLabels: []}`)
+}
+
+func (s MySuite) TestStaticLabels(c *C) {
+	opts := parseOpts{labels: map[string]string{"dc": "us-east", "team": "infra"}}
+	w := httptest.NewRecorder()
+	_, err := serveMetricsFromText(opts, w, httptest.NewRequest("GET", "/", nil), "a 1\nb{team=\"db\",x=\"y\"} 2\n")
+	c.Assert(err, IsNil)
+	body := w.Body.String()
+	for _, line := range []string{
+		`a{dc="us-east",team="infra"} 1`,
+		`b{dc="us-east",team="infra",x="y"} 2`,
+	} {
+		c.Check(strings.Contains(body, line+"\n"), Equals, true, Commentf("missing %q in %s", line, body))
+	}
+
+	pms, err := translateOpenTsdb("a.a 0 1 team=db", opts)
+	c.Assert(err, IsNil)
+	c.Check(pms[0].Desc().String(), Equals, `Desc{fqName: "a_a", help: "help", constLabels: {dc="us-east",team="infra"}, variableLabels: []}`)
+
+	opts.labelsError = true
+	_, _, err = gathererFromText(opts, "b{team=\"db\"} 2\n")
+	c.Check(err, Not(IsNil))
+	_, err = translateOpenTsdb("a.a 0 1 team=db", opts)
+	c.Check(err, Not(IsNil))
+	_, _, err = gathererFromText(opts, "b{x=\"y\"} 2\n")
+	c.Check(err, IsNil)
+}
+
+func (s MySuite) TestTranslateOpentsdbTypes(c *C) {
+	ot := `# TYPE a.a counter
+# HELP a.a things that happened
+# TYPE a_b untyped
+# an ordinary comment
+a.a 0 1
+a.b 0 2
+a.c 0 3
+`
+	pms, err := translateOpenTsdb(ot, parseOpts{})
+	c.Assert(err, IsNil)
+	c.Assert(len(pms), Equals, 3)
+	c.Check(pms[0].Desc().String(), Equals, `Desc{fqName: "a_a", help: "things that happened", constLabels: {}, variableLabels: []}`)
+
+	var m dto.Metric
+	pms[0].Write(&m)
+	c.Check(m.GetCounter().GetValue(), Equals, 1.0)
+	m.Reset()
+	pms[1].Write(&m)
+	c.Check(m.GetUntyped().GetValue(), Equals, 2.0)
+	m.Reset()
+	pms[2].Write(&m)
+	c.Check(m.GetGauge().GetValue(), Equals, 3.0)
+
+	_, err = translateOpenTsdb("# TYPE a.a summary\na.a 0 1\n", parseOpts{})
+	c.Check(err, Not(IsNil))
+}
+
+func (s MySuite) TestTranslateOpentsdbTypeTag(c *C) {
+	pms, err := translateOpenTsdb("a.b_total 0 1 __type__=counter host=x\na.c 0 2 __type__=untyped\n", parseOpts{})
+	c.Assert(err, IsNil)
+	c.Assert(len(pms), Equals, 2)
+	c.Check(pms[0].Desc().String(), Equals, `Desc{fqName: "a_b_total", help: "help", constLabels: {host="x"}, variableLabels: []}`)
+
+	var m dto.Metric
+	pms[0].Write(&m)
+	c.Check(m.GetCounter().GetValue(), Equals, 1.0)
+	m.Reset()
+	pms[1].Write(&m)
+	c.Check(m.GetUntyped().GetValue(), Equals, 2.0)
+
+	w := httptest.NewRecorder()
+	_, err = serveMetricsFromText(parseOpts{opentsdb: true}, w, httptest.NewRequest("GET", "/", nil),
+		"a.b_total 0 1 __type__=counter\n")
+	c.Assert(err, IsNil)
+	c.Check(w.Body.String(), Matches, `(?s).*# TYPE a_b_total counter\na_b_total 1\n.*`)
+
+	_, err = translateOpenTsdb("a.a 0 1 __type__=summary\n", parseOpts{})
+	c.Check(err, Not(IsNil))
+	_, err = translateOpenTsdb("# TYPE a.a gauge\na.a 0 1 __type__=counter\n", parseOpts{})
+	c.Check(err, Not(IsNil))
+}
+
+func (s MySuite) TestParseStatsOldest(c *C) {
+	_, stats, err := gathererFromText(parseOpts{}, "a 1 1500000000000\nb 2 1400000000000\nc 3\n")
+	c.Assert(err, IsNil)
+	c.Check(stats.timeseries, Equals, 3)
+	c.Check(stats.oldest.Equal(time.Unix(1400000000, 0)), Equals, true, Commentf("%v", stats.oldest))
+	c.Check(stats.duration > 0, Equals, true)
+
+	// OpenTSDB timestamps may be in seconds or milliseconds.
+	_, stats, err = gathererFromText(parseOpts{opentsdb: true}, "a 1500000000 1\nb 1400000000500 2\n")
+	c.Assert(err, IsNil)
+	c.Check(stats.oldest.Equal(time.Unix(1400000000, 5e8)), Equals, true, Commentf("%v", stats.oldest))
+}
+
+func (s MySuite) TestStripCR(c *C) {
+	prom := "# HELP a some help\r\n# TYPE a counter\r\na{x=\"y\"} 1\r\nb 2\r\n"
+	otsdb := "# TYPE a.a counter\r\na.a 0 1 host=x\r\nb 1 2\r\n"
+
+	_, _, err := gathererFromText(parseOpts{}, prom)
+	c.Check(err, Not(IsNil))
+
+	for _, opts := range []parseOpts{{stripCR: true}, {stripCR: true, opentsdb: true}} {
+		text := prom
+		if opts.opentsdb {
+			text = otsdb
+		}
+		g, stats, err := gathererFromText(opts, text)
+		c.Assert(err, IsNil, Commentf("opentsdb=%v", opts.opentsdb))
+		c.Check(stats.timeseries, Equals, 2)
+		fams, err := g.Gather()
+		c.Assert(err, IsNil)
+		for _, fam := range fams {
+			c.Check(strings.Contains(fam.String(), `\r`), Equals, false, Commentf("%s", fam))
+		}
+	}
+
+	// OpenTSDB lines are stripped of carriage returns regardless.
+	pms, err := translateOpenTsdb(otsdb, parseOpts{})
+	c.Assert(err, IsNil)
+	c.Check(pms[0].Desc().String(), Equals, `Desc{fqName: "a_a", help: "help", constLabels: {host="x"}, variableLabels: []}`)
+}
+
+func (s MySuite) TestLatin1(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"latin1":          "#!/bin/sh\nprintf 'temp{city=\"Montr\\351al\"} 21\\n'\n",
+		"latin1_repeated": "#!/bin/sh\nprintf 'temp{city=\"Montr\\351al\"} 21\\n'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{},
+		&Config{Scripts: map[string]ScriptConfig{
+			"latin1":          {Encoding: encodingLatin1},
+			"latin1_repeated": {Encoding: encodingLatin1, Repeat: 2},
+		}})
+	go sh.Start()
+
+	for _, script := range []string{"latin1", "latin1_repeated"} {
+		rr := httptest.NewRecorder()
+		sh.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics/"+script, nil))
+		c.Assert(rr.Code, Equals, 200, Commentf("%s", script))
+		c.Check(strings.Contains(rr.Body.String(), `temp{city="Montréal"} 21`), Equals, true, Commentf("%s: %s", script, rr.Body))
+	}
+
+	// Otherwise output is passed through unchanged.
+	text := "temp{city=\"Montr\xe9al\"} 21\n"
+	for latin1, want := range map[bool]string{false: "Montr\xe9al", true: "Montréal"} {
+		g, _, err := gathererFromText(parseOpts{latin1: latin1}, text)
+		c.Assert(err, IsNil)
+		fams, err := g.Gather()
+		c.Assert(err, IsNil)
+		c.Check(fams[0].Metric[0].Label[0].GetValue(), Equals, want)
+	}
+}
+
+func (s MySuite) TestMergeFamilies(c *C) {
+	text := `# HELP a first
+# TYPE a gauge
+a{x="1"} 1
+a{x="2"} 2
+b 5
+# TYPE a gauge
+a{x="3"} 3
+a{x="1"} 4
+# HELP a second
+c 6
+`
+	_, _, err := gathererFromText(parseOpts{}, text)
+	c.Assert(err, Not(IsNil))
+
+	w := httptest.NewRecorder()
+	stats, err := serveMetricsFromText(parseOpts{mergeFamilies: true}, w, httptest.NewRequest("GET", "/", nil), text)
+	c.Assert(err, IsNil)
+	c.Check(stats.timeseries, Equals, 5)
+	body := w.Body.String()
+	for _, line := range []string{
+		"# HELP a first",
+		`a{x="1"} 4`,
+		`a{x="2"} 2`,
+		`a{x="3"} 3`,
+		"b 5",
+		"c 6",
+	} {
+		c.Check(strings.Contains(body, line+"\n"), Equals, true, Commentf("missing %q in %s", line, body))
+	}
+
+	_, _, err = gathererFromText(parseOpts{mergeFamilies: true}, "# TYPE a gauge\na 1\n# TYPE a counter\na 2\n")
+	c.Check(err, Not(IsNil))
+}
+
+func (s MySuite) TestGathererFromRuns(c *C) {
+	runs := []string{
+		"# TYPE a gauge\na{x=\"1\"} 1\na{x=\"2\"} 10\nb 3\n# TYPE h histogram\nh_bucket{le=\"+Inf\"} 1\nh_sum 1\nh_count 1\n",
+		"# TYPE a gauge\na{x=\"1\"} 3\nb 5\n# TYPE h histogram\nh_bucket{le=\"+Inf\"} 2\nh_sum 3\nh_count 2\n",
+		"# TYPE a gauge\na{x=\"1\"} 8\nb 1\n# TYPE h histogram\nh_bucket{le=\"+Inf\"} 3\nh_sum 6\nh_count 3\n",
+	}
+	for aggregate, want := range map[string][]string{
+		"":    {`a{x="1"} 4`, `a{x="2"} 10`, "b 3", "h_count 3"},
+		"min": {`a{x="1"} 1`, `a{x="2"} 10`, "b 1", "h_count 3"},
+		"max": {`a{x="1"} 8`, `a{x="2"} 10`, "b 5", "h_count 3"},
+		"sum": {`a{x="1"} 12`, `a{x="2"} 10`, "b 9", "h_count 3"},
+	} {
+		g, stats, err := gathererFromRuns(parseOpts{prefix: "p_"}, runs, aggregate)
+		c.Assert(err, IsNil)
+		c.Check(stats.timeseries, Equals, 4)
+		var buf bytes.Buffer
+		fams, err := g.Gather()
+		c.Assert(err, IsNil)
+		for _, fam := range fams {
+			expfmt.MetricFamilyToText(&buf, fam)
+		}
+		for _, line := range want {
+			c.Check(strings.Contains(buf.String(), "p_"+line+"\n"), Equals, true,
+				Commentf("%s: missing %q in %s", aggregate, line, buf.String()))
+		}
+	}
+
+	// Any run failing to parse is an error.
+	_, _, err := gathererFromRuns(parseOpts{}, []string{"a 1\n", "a\n"}, "")
+	c.Check(err, Not(IsNil))
+}
+
+func (s MySuite) TestTranslateOpentsdbComments(c *C) {
+	ot := `# tcollector output generated by some_collector
+#
+#no space after the hash
+a.a 0 1 host=x
+
+   # indented comment
+a.b 0 2 host=x
+`
+	pms, err := translateOpenTsdb(ot, parseOpts{})
+	c.Assert(err, IsNil)
+	c.Assert(len(pms), Equals, 2)
+	c.Check(pms[0].Desc().String(), Equals, `Desc{fqName: "a_a", help: "help", constLabels: {host="x"}, variableLabels: []}`)
+	c.Check(pms[1].Desc().String(), Equals, `Desc{fqName: "a_b", help: "help", constLabels: {host="x"}, variableLabels: []}`)
+}
+
+func (s MySuite) TestParseNDJSON(c *C) {
+	text := `{"name":"a","value":1,"labels":{"x":"1"}}
+{"name":"a","value":2,"labels":{"x":"2"}}
+
+not json
+{"name":"b","value":3,"type":"counter"}
+{"name":"a","value":5,"labels":{"x":"1"}}
+{"name":"b","value":4,"labels":{"y":"1"},"type":"gauge"}
+{"name":"c"}
+{"value":1}
+{"name":"c","value":1,"type":"histogram"}
+`
+	g, stats, err := gathererFromText(parseOpts{ndjson: true, labels: map[string]string{"z": "1"}}, text)
+	c.Assert(err, IsNil)
+	c.Check(stats.timeseries, Equals, 3)
+	c.Check(stats.skipped, Equals, 6)
+
+	var buf bytes.Buffer
+	fams, err := g.Gather()
+	c.Assert(err, IsNil)
+	for _, fam := range fams {
+		expfmt.MetricFamilyToText(&buf, fam)
+	}
+	c.Check(buf.String(), Equals, "# HELP a help\n# TYPE a gauge\n"+`a{x="1",z="1"} 1`+"\n"+`a{x="2",z="1"} 2`+"\n"+
+		"# HELP b help\n# TYPE b counter\n"+`b{z="1"} 3`+"\n")
+
+	// Output none of which can be parsed is an error.
+	_, _, err = gathererFromText(parseOpts{ndjson: true}, "a 1\n")
+	c.Check(err, Not(IsNil))
+}
+
+func (s MySuite) TestScale(c *C) {
+	opts := parseOpts{prefix: "p_", scale: map[string]float64{"latency_ms": 0.001, "h": 2}}
+	text := "latency_ms{x=\"1\"} 1500\nother 7\n# TYPE h histogram\nh_bucket{le=\"1\"} 1\nh_bucket{le=\"+Inf\"} 2\nh_sum 3\nh_count 2\n"
+	g, _, err := gathererFromText(opts, text)
+	c.Assert(err, IsNil)
+	var buf bytes.Buffer
+	fams, err := g.Gather()
+	c.Assert(err, IsNil)
+	for _, fam := range fams {
+		expfmt.MetricFamilyToText(&buf, fam)
+	}
+	for _, line := range []string{`p_latency_ms{x="1"} 1.5`, "p_other 7", `p_h_bucket{le="2"} 1`, "p_h_sum 6", "p_h_count 2"} {
+		c.Check(strings.Contains(buf.String(), line+"\n"), Equals, true, Commentf("missing %q in %s", line, buf.String()))
+	}
+
+	opts.opentsdb = true
+	metrics, err := translateOpenTsdb("latency_ms 1500000000 250 x=1\nother 1500000000 7\n", opts)
+	c.Assert(err, IsNil)
+	c.Assert(metrics, HasLen, 2)
+	var m dto.Metric
+	c.Assert(metrics[0].Write(&m), IsNil)
+	c.Check(m.GetGauge().GetValue(), Equals, 0.25)
+	c.Assert(metrics[1].Write(&m), IsNil)
+	c.Check(m.GetGauge().GetValue(), Equals, 7.0)
+}
+
+func (s MySuite) TestTranslateOpentsdbHelpTag(c *C) {
+	pms, err := translateOpenTsdb("disk.used 0 1 __help__=\"Disk usage, in bytes\" dev=sda\ndisk.used 0 2 dev=sdb\nload 0 3 __help__=load,host=x\n", parseOpts{})
+	c.Assert(err, IsNil)
+	c.Assert(len(pms), Equals, 3)
+	c.Check(pms[0].Desc().String(), Equals, `Desc{fqName: "disk_used", help: "Disk usage, in bytes", constLabels: {dev="sda"}, variableLabels: []}`)
+	c.Check(pms[1].Desc().String(), Equals, `Desc{fqName: "disk_used", help: "Disk usage, in bytes", constLabels: {dev="sdb"}, variableLabels: []}`)
+	c.Check(pms[2].Desc().String(), Equals, `Desc{fqName: "load", help: "load", constLabels: {host="x"}, variableLabels: []}`)
+
+	w := httptest.NewRecorder()
+	_, err = serveMetricsFromText(parseOpts{opentsdb: true}, w, httptest.NewRequest("GET", "/", nil),
+		"a.b 0 1 __help__=\"a \\\"quoted\\\" b\"\n")
+	c.Assert(err, IsNil)
+	c.Check(w.Body.String(), Matches, `(?s).*# HELP a_b a "quoted" b\n# TYPE a_b gauge\na_b 1\n.*`)
+
+	for _, bad := range []string{
+		"a 0 1 __help__=x\na 0 2 __help__=y\n",
+		"# HELP a x\na 0 1 __help__=y\n",
+		"a 0 1 __help__=\"unterminated\n",
+	} {
+		_, err = translateOpenTsdb(bad, parseOpts{})
+		c.Check(err, Not(IsNil), Commentf("%s", bad))
+	}
+}
+
+func (s MySuite) TestQuantileName(c *C) {
+	for name, want := range map[string]float64{
+		"lat_p5": 0.05, "lat_p50": 0.5, "lat_p99": 0.99, "lat_p999": 0.999, "lat_p100": 1,
+	} {
+		base, q, ok := quantileName(name)
+		c.Check(ok, Equals, true, Commentf("%s", name))
+		c.Check(base, Equals, "lat")
+		c.Check(q, Equals, want, Commentf("%s", name))
+	}
+	for _, name := range []string{"lat", "p99", "lat_p", "lat_pct"} {
+		_, _, ok := quantileName(name)
+		c.Check(ok, Equals, false, Commentf("%s", name))
+	}
+}
+
+func (s MySuite) TestTranslateOpentsdbQuantiles(c *C) {
+	opts := parseOpts{opentsdb: true, quantiles: true}
+	w := httptest.NewRecorder()
+	_, err := serveMetricsFromText(opts, w, httptest.NewRequest("GET", "/", nil), `# HELP rpc.latency RPC latency in seconds
+rpc.latency_p50 0 0.1 method=get
+rpc.latency_p99 0 0.5 method=get
+rpc.latency_count 0 20 method=get
+rpc.latency_sum 0 3 method=get
+rpc.latency_p50 0 0.2 method=put
+rpc.latency_count 0 5 method=post
+`)
+	c.Assert(err, IsNil)
+	c.Check(w.Body.String(), Equals, `# HELP rpc_latency RPC latency in seconds
+# TYPE rpc_latency summary
+rpc_latency{method="get",quantile="0.5"} 0.1
+rpc_latency{method="get",quantile="0.99"} 0.5
+rpc_latency_sum{method="get"} 3
+rpc_latency_count{method="get"} 20
+rpc_latency{method="put",quantile="0.5"} 0.2
+rpc_latency_sum{method="put"} 0
+rpc_latency_count{method="put"} 0
+# HELP rpc_latency_count help
+# TYPE rpc_latency_count gauge
+rpc_latency_count{method="post"} 5
+`)
+
+	// Explicitly typed metrics are left alone, as is everything without
+	// the option.
+	metrics, err := translateOpenTsdb("lat_p50 0 1 __type__=counter\n", opts)
+	c.Assert(err, IsNil)
+	c.Check(metrics[0].Desc().String(), Matches, `Desc{fqName: "lat_p50".*`)
+	metrics, err = translateOpenTsdb("lat_p50 0 1\n", parseOpts{})
+	c.Assert(err, IsNil)
+	c.Check(metrics[0].Desc().String(), Matches, `Desc{fqName: "lat_p50".*`)
+
+	_, err = translateOpenTsdb("lat_p50 0 1\nlat_p50 0 2\n", opts)
+	c.Check(err, Not(IsNil))
+}
+
+func (s MySuite) TestRegathererOrder(c *C) {
+	var text string
+	for i := 0; i < 20; i++ {
+		text += fmt.Sprintf("m%02d 1\n", (i*7)%20)
+	}
+	g, _, err := gathererFromText(parseOpts{}, text)
+	c.Assert(err, IsNil)
+	for i := 0; i < 5; i++ {
+		fams, err := g.Gather()
+		c.Assert(err, IsNil)
+		c.Assert(fams, HasLen, 20)
+		for j, fam := range fams {
+			c.Check(fam.GetName(), Equals, fmt.Sprintf("m%02d", j))
+		}
+	}
+}
@@ -0,0 +1,115 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// lookupCredential translates username and groupname, either of which may be
+// a name or a numeric ID, into a credential.  If groupname is empty the
+// user's primary group is used; if username is empty our own uid is used.
+func lookupCredential(username, groupname string) (*syscall.Credential, error) {
+	cred := &syscall.Credential{
+		Uid:         uint32(os.Geteuid()),
+		Gid:         uint32(os.Getegid()),
+		NoSetGroups: os.Geteuid() != 0,
+	}
+
+	if username != "" {
+		if id, err := strconv.ParseUint(username, 10, 32); err == nil {
+			cred.Uid = uint32(id)
+		} else {
+			u, err := user.Lookup(username)
+			if err != nil {
+				return nil, err
+			}
+			uid, err := strconv.ParseUint(u.Uid, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("user '%s' has non-numeric uid '%s'", username, u.Uid)
+			}
+			gid, err := strconv.ParseUint(u.Gid, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("user '%s' has non-numeric gid '%s'", username, u.Gid)
+			}
+			cred.Uid, cred.Gid = uint32(uid), uint32(gid)
+		}
+	}
+
+	if groupname != "" {
+		if id, err := strconv.ParseUint(groupname, 10, 32); err == nil {
+			cred.Gid = uint32(id)
+		} else {
+			g, err := user.LookupGroup(groupname)
+			if err != nil {
+				return nil, err
+			}
+			gid, err := strconv.ParseUint(g.Gid, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("group '%s' has non-numeric gid '%s'", groupname, g.Gid)
+			}
+			cred.Gid = uint32(gid)
+		}
+	}
+
+	return cred, nil
+}
+
+// checkCredential verifies that username and groupname exist and that we
+// have the privileges needed to run scripts as them.
+func checkCredential(username, groupname string) error {
+	if username == "" && groupname == "" {
+		return nil
+	}
+	cred, err := lookupCredential(username, groupname)
+	if err != nil {
+		return err
+	}
+	if os.Geteuid() != 0 && (int(cred.Uid) != os.Geteuid() || int(cred.Gid) != os.Getegid()) {
+		return fmt.Errorf("must be root to run scripts as uid %d gid %d", cred.Uid, cred.Gid)
+	}
+	return nil
+}
+
+// setCredential arranges for cmd to run as username and groupname.  If both
+// are empty cmd is left to run as ourselves.
+func setCredential(cmd *exec.Cmd, username, groupname string) error {
+	if username == "" && groupname == "" {
+		return nil
+	}
+	cred, err := lookupCredential(username, groupname)
+	if err != nil {
+		return err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = cred
+	return nil
+}
+
+// setProcessGroup arranges for cmd to be started in a new process group, so
+// that signals sent by terminateProcessGroup and killProcessGroup also reach
+// any children it spawns.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// terminateProcessGroup sends SIGTERM to the process group led by cmd.
+func terminateProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+// killProcessGroup sends SIGKILL to the process group led by cmd.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
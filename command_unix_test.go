@@ -0,0 +1,115 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	. "gopkg.in/check.v1"
+)
+
+func (s MySuite) TestLookupCredential(c *C) {
+	cred, err := lookupCredential("root", "")
+	c.Assert(err, IsNil)
+	c.Check(cred.Uid, Equals, uint32(0))
+	c.Check(cred.Gid, Equals, uint32(0))
+
+	cred, err = lookupCredential("123", "456")
+	c.Assert(err, IsNil)
+	c.Check(cred.Uid, Equals, uint32(123))
+	c.Check(cred.Gid, Equals, uint32(456))
+
+	_, err = lookupCredential("no-such-user-here", "")
+	c.Check(err, Not(IsNil))
+	_, err = lookupCredential("", "no-such-group-here")
+	c.Check(err, Not(IsNil))
+}
+
+func (s MySuite) TestRunCommandCredential(c *C) {
+	// We can always run as ourselves, root or not.
+	uid, gid := fmt.Sprint(os.Geteuid()), fmt.Sprint(os.Getegid())
+	c.Assert(checkCredential(uid, gid), IsNil)
+	out, err := runCommand(context.Background(), commandOpts{user: uid, group: gid}, "id", "-u")
+	c.Assert(err, IsNil)
+	c.Check(out, Equals, uid+"\n")
+}
+
+// processRunning returns true if pid exists and isn't a zombie.
+func processRunning(pid int) bool {
+	out, err := exec.Command("ps", "-o", "stat=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		// ps exits nonzero when there's no such process.
+		return false
+	}
+	return !strings.HasPrefix(strings.TrimSpace(string(out)), "Z")
+}
+
+func (s MySuite) TestRunCommandCancelGrandchild(c *C) {
+	os.Remove("pid")
+	defer os.Remove("pid")
+
+	// Cancelling a script must also kill any children it has backgrounded,
+	// not just the script itself.
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := runCommand(ctx, commandOpts{}, "bash", "-c", "sleep 30 & echo $! > pid; wait")
+	c.Check(err, Equals, timeoutError{})
+	c.Check(time.Since(start) < time.Second, Equals, true)
+
+	pidstr, err := ioutil.ReadFile("pid")
+	c.Assert(err, IsNil)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidstr)))
+	c.Assert(err, IsNil)
+
+	// SIGKILL delivery is asynchronous, so allow the grandchild a moment to die.
+	deadline := time.Now().Add(time.Second)
+	for processRunning(pid) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(processRunning(pid), Equals, false)
+}
+
+func (s MySuite) TestClientDisconnect(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"deserted": "#!/bin/sh\ncd \"$(dirname \"$0\")\"\necho $$ > pid\nexec sleep 5\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{}, nil)
+	go sh.Start()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	sh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics/deserted", nil).WithContext(ctx))
+	c.Check(time.Since(start) < time.Second, Equals, true)
+
+	// The script has been killed and reaped.
+	pid, err := ioutil.ReadFile(path.Join(dir, "pid"))
+	c.Assert(err, IsNil)
+	p, err := strconv.Atoi(strings.TrimSpace(string(pid)))
+	c.Assert(err, IsNil)
+	c.Check(syscall.Kill(p, 0), Equals, syscall.ESRCH)
+
+	for vec, want := range map[*prometheus.CounterVec]float64{
+		mDisconnects: 1, mCanceled: 1, mErrors: 0, mTimeouts: 0,
+	} {
+		var m dto.Metric
+		c.Assert(vec.WithLabelValues("deserted").Write(&m), IsNil)
+		c.Check(m.GetCounter().GetValue(), Equals, want)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// checkCredential always fails if a user or group is given, since running
+// scripts as another user isn't supported on Windows.
+func checkCredential(username, groupname string) error {
+	if username == "" && groupname == "" {
+		return nil
+	}
+	return fmt.Errorf("running scripts as another user is not supported on windows")
+}
+
+// setCredential always fails if a user or group is given, since running
+// scripts as another user isn't supported on Windows.
+func setCredential(cmd *exec.Cmd, username, groupname string) error {
+	return checkCredential(username, groupname)
+}
+
+// setProcessGroup does nothing on Windows.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// terminateProcessGroup kills cmd, since Windows has no SIGTERM.  Any
+// children it has spawned are left running.
+func terminateProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// killProcessGroup kills cmd.  Any children it has spawned are left running.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,736 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ScriptConfig holds the settings which may be given for an individual
+// script.  Fields left at their zero value fall back to the defaults
+// given on the command line.
+type ScriptConfig struct {
+	// Workdir is the working directory the script is run in.  A relative
+	// path is interpreted relative to the exporter's working directory.
+	Workdir string `yaml:"workdir"`
+
+	// If WorkdirFromScript is true and no Workdir is set, the script is run
+	// in the directory containing it.
+	WorkdirFromScript bool `yaml:"workdir_from_script"`
+
+	// User and Group to run the script as, given as names or numeric IDs.
+	User  string `yaml:"user"`
+	Group string `yaml:"group"`
+
+	// KillGracePeriod is how long a script has to exit after being sent
+	// SIGTERM on timeout, before it is sent SIGKILL.
+	KillGracePeriod time.Duration `yaml:"kill_grace_period"`
+
+	// Timeout, if set, is the soft timeout of the script in place of
+	// -timeout: once it has passed the script is sent SIGTERM.  It's still
+	// cut short by the scrape timeout.  If HardTimeout is set, the script is
+	// sent SIGKILL once that long has passed since it started rather than
+	// KillGracePeriod after SIGTERM.
+	Timeout     time.Duration `yaml:"timeout"`
+	HardTimeout time.Duration `yaml:"hard_timeout"`
+
+	// If ServeOnTimeout is true, whatever the script wrote to stdout before
+	// exiting is served even if it timed out, as long as it parses, and a
+	// script_success metric is added as for ServeOnExitError.  It's off by
+	// default, since a script cut short may have written only some of its
+	// metrics, and a timeout has always failed the scrape.
+	ServeOnTimeout bool `yaml:"serve_on_timeout"`
+
+	// MetricPrefix is prepended to the name of every metric the script emits.
+	MetricPrefix string `yaml:"metric_prefix"`
+
+	// If VerboseErrors is true, the response to a failed scrape includes
+	// the error and what the script wrote to stderr.
+	VerboseErrors bool `yaml:"verbose_errors"`
+
+	// If Interval is nonzero, the script is run in the background every
+	// Interval rather than when scraped, and scrapes are served the output
+	// of its latest run.
+	Interval time.Duration `yaml:"interval"`
+
+	// Jitter delays the first scheduled run by a random fraction, between
+	// 0 and Jitter, of Interval, so that scripts sharing an interval don't
+	// all run at once.  It must be between 0 and 1.
+	Jitter float64 `yaml:"jitter"`
+
+	// If ServeOnExitError is true, the script's output is served even if it
+	// exits with nonzero status, and a script_success metric is added to
+	// the output to indicate whether it did.
+	ServeOnExitError bool `yaml:"serve_on_exit_error"`
+
+	// If SuccessRegex is set, a run of the script only counts as successful
+	// if its output matches it, for scripts which report failure in their
+	// output rather than their exit status.  A script_success metric is
+	// added to the output as for ServeOnExitError.  If
+	// SuccessRegexDropMetrics is true, the output of a run which doesn't
+	// match isn't served, leaving just script_success.
+	SuccessRegex            string `yaml:"success_regex"`
+	SuccessRegexDropMetrics bool   `yaml:"success_regex_drop_metrics"`
+
+	successRe *regexp.Regexp
+
+	// If PushgatewayURL is set, the output of each scheduled run is also
+	// pushed to the Pushgateway at that URL, under the job PushJob.  If
+	// PushJob is empty the script name is used, with any slashes replaced
+	// by underscores.  Only valid for scripts with an Interval.
+	PushgatewayURL string `yaml:"pushgateway_url"`
+	PushJob        string `yaml:"push_job"`
+
+	// SuccessExitCodes lists nonzero exit statuses which are treated as
+	// success, for tools which use them to signal warnings.
+	SuccessExitCodes []int `yaml:"success_exit_codes"`
+
+	// If StderrIsError is false, a script writing to stderr isn't
+	// considered to have failed; what it writes is logged instead, as
+	// StderrLog says.  Defaults to true.
+	StderrIsError *bool `yaml:"stderr_is_error"`
+
+	// StderrLog is either "lines", to log each line written to stderr as
+	// soon as it's written, or "summary", to log everything written once
+	// the script exits.
+	StderrLog string `yaml:"stderr_log"`
+
+	// Args are passed to the script before any taken from the request
+	// path.  Each is a text/template, rendered with .Param holding the
+	// request's query parameters and .Env holding the environment
+	// variables listed in ArgsEnv, e.g. "--target={{.Param.target}}".
+	Args    []string `yaml:"args"`
+	ArgsEnv []string `yaml:"args_env"`
+
+	// PassHeaders lists request headers to pass to the script as
+	// environment variables named as in CGI, e.g. X-Tenant-ID becomes
+	// HTTP_X_TENANT_ID.  Other headers aren't passed, so that credentials
+	// sent to the exporter don't reach scripts.
+	PassHeaders []string `yaml:"pass_headers"`
+
+	// Params restricts the values of query parameters, by name.  A
+	// request with a value that isn't allowed is rejected.
+	Params map[string]*ParamConfig `yaml:"params"`
+
+	// RelabelConfigs are applied in order to the metrics parsed from the
+	// script's output before they're served.
+	RelabelConfigs []*RelabelConfig `yaml:"relabel_configs"`
+
+	// If EmptyOutputIsError is true, a script which exits successfully
+	// without writing anything but whitespace to stdout is treated as
+	// having produced unparseable output.
+	EmptyOutputIsError bool `yaml:"empty_output_is_error"`
+
+	// Labels are added to every metric the script emits, before
+	// RelabelConfigs are applied.  LabelConflict says what happens when
+	// the script emits a label of the same name: "override" (the default)
+	// replaces its value, "error" treats the output as unparseable.
+	Labels        map[string]string `yaml:"labels"`
+	LabelConflict string            `yaml:"label_conflict"`
+
+	// Scale gives factors to multiply the values of metrics by, keyed by
+	// the name the script gives the metric, e.g. 0.001 to convert
+	// milliseconds to seconds.  Factors must be positive.  The sums, quantiles and bucket bounds of
+	// summaries and histograms are scaled, but not their counts.
+	Scale map[string]float64 `yaml:"scale"`
+
+	// If OutputFile is set, metrics are read from the file it names once
+	// the script exits successfully, rather than from stdout.  A relative
+	// path is relative to the script's working directory.  The script not
+	// writing the file is an error.  If RemoveOutputFile is true, the file
+	// is removed after each run.
+	OutputFile       string `yaml:"output_file"`
+	RemoveOutputFile bool   `yaml:"remove_output_file"`
+
+	// ConcurrencyKey says what the limit on concurrent invocations applies
+	// to: "name" (the default) limits invocations of the script whatever
+	// its arguments, "args" limits invocations with the same arguments,
+	// so that e.g. requests for distinct targets run in parallel.
+	ConcurrencyKey string `yaml:"concurrency_key"`
+
+	// Workers, if set, overrides -script-workers as the limit on
+	// concurrent invocations of the script.  Zero disables the script:
+	// requests for it get a 403 response without it being run.  Changes
+	// to a nonzero limit take effect when the exporter is restarted, but
+	// the script can be disabled and enabled again by reloading the config.
+	Workers *int `yaml:"workers"`
+
+	// TimeoutCommand, if set, is run when the script times out, e.g. to
+	// clean up after it, with the script's path appended as its last
+	// argument.  It's given 10s to complete.
+	TimeoutCommand []string `yaml:"timeout_command"`
+
+	// FilterCommand, if set, is run on the script's output before it's
+	// parsed, e.g. ["grep", "-v", "debug"]: the output is its stdin, and
+	// what it writes to stdout is parsed instead.  It runs with the same
+	// working directory and credentials as the script, within the same
+	// timeout.  Its failing is counted in script_filter_errors_total.
+	FilterCommand []string `yaml:"filter_command"`
+
+	// ExpectedMetrics, if set, lists the names of the metrics the script
+	// is expected to emit, after MetricPrefix and RelabelConfigs are
+	// applied.  Output with metrics missing or not listed is still served,
+	// but logged and counted by script_schema_violation_total.
+	ExpectedMetrics []string `yaml:"expected_metrics"`
+
+	// If MergeFamilies is true, a metric family declared more than once in
+	// the script's output, e.g. because it concatenates the output of
+	// several commands, is merged rather than being a parse error.
+	MergeFamilies bool `yaml:"merge_families"`
+
+	// Format is the format of the script's output: "prometheus", "opentsdb"
+	// or "ndjson".  By default it's OpenTSDB with -opentsdb and Prometheus
+	// otherwise.
+	Format string `yaml:"format"`
+
+	// If OpenTSDBQuantiles is true, OpenTSDB metrics whose names end in a
+	// percentile suffix like _p99 are grouped into summaries with a
+	// quantile label.
+	OpenTSDBQuantiles bool `yaml:"opentsdb_quantiles"`
+
+	// Encoding is the character encoding of the script's output: "utf-8",
+	// the default, or "latin1" (ISO 8859-1), which is converted to UTF-8
+	// before parsing.
+	Encoding string `yaml:"encoding"`
+
+	// Nice, if nonzero, is the niceness to run the script with, from -20
+	// to 19.  IOClass, if set, is the I/O scheduling class to run it in:
+	// "realtime", "best-effort" or "idle".  IOPriority is its priority
+	// within the realtime and best-effort classes, from 0 (highest) to 7.
+	// Only supported on Linux.
+	Nice       int    `yaml:"nice"`
+	IOClass    string `yaml:"io_class"`
+	IOPriority int    `yaml:"io_priority"`
+
+	// MemoryLimit, FileLimit and CPULimit, if nonzero, limit the bytes of
+	// address space (RLIMIT_AS), open files (RLIMIT_NOFILE) and CPU time
+	// (RLIMIT_CPU, in whole seconds) the script may use.  Only supported
+	// on Linux.
+	MemoryLimit uint64        `yaml:"memory_limit"`
+	FileLimit   uint64        `yaml:"file_limit"`
+	CPULimit    time.Duration `yaml:"cpu_limit"`
+
+	// If Repeat is more than 1, the script is run that many times in
+	// succession for each scrape, and the values of each gauge, counter
+	// and untyped metric across the runs are combined using Aggregate:
+	// "avg" (the default), "min", "max" or "sum".  Summaries and
+	// histograms are taken from the last run.  If any run fails, the
+	// scrape fails.
+	Repeat    int    `yaml:"repeat"`
+	Aggregate string `yaml:"aggregate"`
+
+	// If CircuitBreakerFailures is set, once the script has failed that
+	// many times in a row it isn't run for CircuitBreakerCooldown (1m by
+	// default): requests get the result of its latest failure instead.
+	// The next request after the cooldown runs the script as a trial; if
+	// that fails too, the cooldown doubles, up to 32 times its configured
+	// length.
+	CircuitBreakerFailures int           `yaml:"circuit_breaker_failures"`
+	CircuitBreakerCooldown time.Duration `yaml:"circuit_breaker_cooldown"`
+}
+
+// outputMatches returns true unless sc has a success regex which output
+// doesn't match.
+func (sc ScriptConfig) outputMatches(output string) bool {
+	return sc.successRe == nil || sc.successRe.MatchString(output)
+}
+
+// stderrIsError returns true unless sc says that stderr output isn't an
+// error.
+func (sc ScriptConfig) stderrIsError() bool {
+	return sc.StderrIsError == nil || *sc.StderrIsError
+}
+
+// Values for ScriptConfig.StderrLog.
+const (
+	stderrLogLines   = "lines"
+	stderrLogSummary = "summary"
+)
+
+// checkStderrLog returns an error if s isn't a valid value for
+// ScriptConfig.StderrLog.
+func checkStderrLog(s string) error {
+	switch s {
+	case "", stderrLogLines, stderrLogSummary:
+		return nil
+	}
+	return fmt.Errorf("unknown stderr log mode '%s'", s)
+}
+
+// Values for ScriptConfig.Format.
+const (
+	formatPrometheus = "prometheus"
+	formatOpenTSDB   = "opentsdb"
+	formatNDJSON     = "ndjson"
+)
+
+// checkFormat returns an error if s isn't a valid value for
+// ScriptConfig.Format.
+func checkFormat(s string) error {
+	switch s {
+	case "", formatPrometheus, formatOpenTSDB, formatNDJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown format '%s'", s)
+}
+
+// Values for ScriptConfig.Encoding.
+const (
+	encodingUTF8   = "utf-8"
+	encodingLatin1 = "latin1"
+)
+
+// checkEncoding returns an error if s isn't a valid value for
+// ScriptConfig.Encoding.
+func checkEncoding(s string) error {
+	switch s {
+	case "", encodingUTF8, encodingLatin1:
+		return nil
+	}
+	return fmt.Errorf("unknown encoding '%s'", s)
+}
+
+// Values for ScriptConfig.LabelConflict.
+const (
+	labelConflictOverride = "override"
+	labelConflictError    = "error"
+)
+
+// checkLabelConflict returns an error if s isn't a valid value for
+// ScriptConfig.LabelConflict.
+func checkLabelConflict(s string) error {
+	switch s {
+	case "", labelConflictOverride, labelConflictError:
+		return nil
+	}
+	return fmt.Errorf("unknown label conflict mode '%s'", s)
+}
+
+// Values for ScriptConfig.ConcurrencyKey.
+const (
+	concurrencyKeyName = "name"
+	concurrencyKeyArgs = "args"
+)
+
+// checkConcurrencyKey returns an error if s isn't a valid value for
+// ScriptConfig.ConcurrencyKey.
+func checkConcurrencyKey(s string) error {
+	switch s {
+	case "", concurrencyKeyName, concurrencyKeyArgs:
+		return nil
+	}
+	return fmt.Errorf("unknown concurrency key '%s'", s)
+}
+
+// Values for ScriptConfig.Aggregate.
+const (
+	aggregateAvg = "avg"
+	aggregateMin = "min"
+	aggregateMax = "max"
+	aggregateSum = "sum"
+)
+
+// checkAggregate returns an error if s isn't a valid value for
+// ScriptConfig.Aggregate.
+func checkAggregate(s string) error {
+	switch s {
+	case "", aggregateAvg, aggregateMin, aggregateMax, aggregateSum:
+		return nil
+	}
+	return fmt.Errorf("unknown aggregation function '%s'", s)
+}
+
+// Values for ScriptConfig.IOClass.
+const (
+	ioClassRealtime   = "realtime"
+	ioClassBestEffort = "best-effort"
+	ioClassIdle       = "idle"
+)
+
+// checkPriority returns an error if the priority settings in sc are invalid.
+func checkPriority(sc ScriptConfig) error {
+	if sc.Nice < -20 || sc.Nice > 19 {
+		return fmt.Errorf("nice %d not between -20 and 19", sc.Nice)
+	}
+	switch sc.IOClass {
+	case "", ioClassRealtime, ioClassBestEffort, ioClassIdle:
+	default:
+		return fmt.Errorf("unknown io_class '%s'", sc.IOClass)
+	}
+	if sc.IOPriority < 0 || sc.IOPriority > 7 {
+		return fmt.Errorf("io_priority %d not between 0 and 7", sc.IOPriority)
+	}
+	return nil
+}
+
+// Config describes the contents of the file named by -config.file.  It may
+// be written in YAML, JSON, or TOML; the yaml tags give the key names in all
+// three.
+type Config struct {
+	// Scripts maps script names, relative to -script.path, to their settings.
+	Scripts map[string]ScriptConfig `yaml:"scripts"`
+
+	// AllScripts lists the scripts run when <metricsPath>/all is requested.
+	// If empty, "all" is treated like any other script name.
+	AllScripts []string `yaml:"all_scripts"`
+
+	// Routes map request paths to scripts.  They are tried in order before
+	// falling back to treating the path as the script name.
+	Routes []Route `yaml:"routes"`
+}
+
+// A Route runs Script for requests whose path matches the regular
+// expression Path.  Args are passed to the script after expanding
+// references like $1 to the submatches of Path; if Args is empty, the
+// submatches themselves are passed.
+type Route struct {
+	Path   string   `yaml:"path"`
+	Script string   `yaml:"script"`
+	Args   []string `yaml:"args"`
+
+	re *regexp.Regexp
+}
+
+// route returns the script and arguments given by the first of cfg's routes
+// matching path.  It returns false if none match.
+func (cfg *Config) route(path string) (string, []string, bool) {
+	if cfg == nil {
+		return "", nil, false
+	}
+	for _, rt := range cfg.Routes {
+		match := rt.re.FindStringSubmatchIndex(path)
+		if match == nil {
+			continue
+		}
+		var args []string
+		if len(rt.Args) == 0 {
+			for i := 2; i < len(match); i += 2 {
+				if match[i] >= 0 {
+					args = append(args, path[match[i]:match[i+1]])
+				}
+			}
+		}
+		for _, arg := range rt.Args {
+			args = append(args, string(rt.re.ExpandString(nil, arg, path, match)))
+		}
+		return rt.Script, args, true
+	}
+	return "", nil, false
+}
+
+// LoadConfig reads and parses the config file named filename.  Files named
+// *.toml are parsed as TOML, anything else as YAML, which JSON is a subset of.
+func LoadConfig(filename string) (*Config, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file '%s': %v", filename, err)
+	}
+	return parseConfig(content, filename)
+}
+
+// parseConfig parses content, read from the file or URL named source, as a
+// config.  Whether it's TOML is decided by the extension of source.
+func parseConfig(content []byte, source string) (*Config, error) {
+	var err error
+	if strings.ToLower(filepath.Ext(source)) == ".toml" {
+		// Rather than maintain a second set of struct tags and decoding
+		// rules, e.g. for durations, convert TOML to YAML.
+		var m map[string]interface{}
+		if _, err := toml.Decode(string(content), &m); err != nil {
+			return nil, fmt.Errorf("unable to parse config file '%s': %v", source, err)
+		}
+		if content, err = yaml.Marshal(m); err != nil {
+			return nil, fmt.Errorf("unable to parse config file '%s': %v", source, err)
+		}
+	}
+	var cfg Config
+	if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse config file '%s': %v", source, err)
+	}
+	for i, rt := range cfg.Routes {
+		if rt.Script == "" {
+			return nil, fmt.Errorf("route '%s' has no script", rt.Path)
+		}
+		cfg.Routes[i].re, err = regexp.Compile(rt.Path)
+		if err != nil {
+			return nil, fmt.Errorf("route '%s' has invalid path regexp: %v", rt.Path, err)
+		}
+	}
+	for name, sc := range cfg.Scripts {
+		if sc.MetricPrefix != "" && !model.IsValidMetricName(model.LabelValue(sc.MetricPrefix)) {
+			return nil, fmt.Errorf("script '%s' has invalid metric_prefix '%s'", name, sc.MetricPrefix)
+		}
+		for _, rc := range sc.RelabelConfigs {
+			if err := rc.compile(); err != nil {
+				return nil, fmt.Errorf("script '%s' has invalid relabel_configs: %v", name, err)
+			}
+		}
+		for param, pc := range sc.Params {
+			if err := pc.compile(); err != nil {
+				return nil, fmt.Errorf("script '%s' has invalid params for '%s': %v", name, param, err)
+			}
+		}
+		for _, arg := range sc.Args {
+			if _, err := parseArgTemplate(arg); err != nil {
+				return nil, fmt.Errorf("script '%s' has invalid argument template '%s': %v", name, arg, err)
+			}
+		}
+		if sc.SuccessRegex != "" {
+			if sc.successRe, err = regexp.Compile(sc.SuccessRegex); err != nil {
+				return nil, fmt.Errorf("script '%s' has invalid success_regex: %v", name, err)
+			}
+			cfg.Scripts[name] = sc
+		}
+		for _, header := range sc.PassHeaders {
+			if err := checkPassHeader(header); err != nil {
+				return nil, fmt.Errorf("script '%s' has invalid pass_headers: %v", name, err)
+			}
+		}
+		if err := checkStderrLog(sc.StderrLog); err != nil {
+			return nil, fmt.Errorf("script '%s' has invalid stderr_log: %v", name, err)
+		}
+		if err := checkFormat(sc.Format); err != nil {
+			return nil, fmt.Errorf("script '%s' has invalid format: %v", name, err)
+		}
+		if err := checkEncoding(sc.Encoding); err != nil {
+			return nil, fmt.Errorf("script '%s' has invalid encoding: %v", name, err)
+		}
+		for label := range sc.Labels {
+			if !model.LabelName(label).IsValid() || strings.HasPrefix(label, "__") {
+				return nil, fmt.Errorf("script '%s' has invalid label name '%s'", name, label)
+			}
+		}
+		if err := checkLabelConflict(sc.LabelConflict); err != nil {
+			return nil, fmt.Errorf("script '%s' has invalid label_conflict: %v", name, err)
+		}
+		for metric, factor := range sc.Scale {
+			if !(factor > 0) || math.IsInf(factor, 0) {
+				return nil, fmt.Errorf("script '%s' has invalid scale factor %v for metric '%s'", name, factor, metric)
+			}
+		}
+		if len(sc.TimeoutCommand) > 0 && sc.TimeoutCommand[0] == "" {
+			return nil, fmt.Errorf("script '%s' has empty timeout_command", name)
+		}
+		if len(sc.FilterCommand) > 0 && sc.FilterCommand[0] == "" {
+			return nil, fmt.Errorf("script '%s' has empty filter_command", name)
+		}
+		if err := checkPriority(sc); err != nil {
+			return nil, fmt.Errorf("script '%s' has invalid priority: %v", name, err)
+		}
+		if sc.CPULimit < 0 {
+			return nil, fmt.Errorf("script '%s' has negative cpu_limit %v", name, sc.CPULimit)
+		}
+		if err := checkConcurrencyKey(sc.ConcurrencyKey); err != nil {
+			return nil, fmt.Errorf("script '%s' has invalid concurrency_key: %v", name, err)
+		}
+		if sc.Workers != nil && *sc.Workers < 0 {
+			return nil, fmt.Errorf("script '%s' has negative workers %d", name, *sc.Workers)
+		}
+		if sc.Repeat < 0 {
+			return nil, fmt.Errorf("script '%s' has negative repeat %d", name, sc.Repeat)
+		}
+		if sc.CircuitBreakerFailures < 0 {
+			return nil, fmt.Errorf("script '%s' has negative circuit_breaker_failures %d", name, sc.CircuitBreakerFailures)
+		}
+		if sc.CircuitBreakerCooldown < 0 {
+			return nil, fmt.Errorf("script '%s' has negative circuit_breaker_cooldown %v", name, sc.CircuitBreakerCooldown)
+		}
+		if err := checkAggregate(sc.Aggregate); err != nil {
+			return nil, fmt.Errorf("script '%s' has invalid aggregate: %v", name, err)
+		}
+		if sc.Timeout < 0 || sc.HardTimeout < 0 {
+			return nil, fmt.Errorf("script '%s' has negative timeout", name)
+		}
+		if sc.HardTimeout > 0 && sc.HardTimeout <= sc.Timeout {
+			return nil, fmt.Errorf("script '%s' has hard_timeout %v not longer than its timeout %v", name, sc.HardTimeout, sc.Timeout)
+		}
+		if sc.Jitter < 0 || sc.Jitter > 1 {
+			return nil, fmt.Errorf("script '%s' has jitter %v, not between 0 and 1", name, sc.Jitter)
+		}
+		if sc.PushgatewayURL != "" && sc.Interval <= 0 {
+			return nil, fmt.Errorf("script '%s' has pushgateway_url but no interval", name)
+		}
+	}
+	return &cfg, nil
+}
+
+// checkConfigCredentials returns an error if any script in cfg, which may be
+// nil, is configured with a user or group it can't be run as.
+func checkConfigCredentials(cfg *Config, defaults ScriptConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	for name, sc := range cfg.Scripts {
+		sc = sc.merge(defaults)
+		if err := checkCredential(sc.User, sc.Group); err != nil {
+			return fmt.Errorf("invalid user or group for script '%s': %v", name, err)
+		}
+	}
+	return nil
+}
+
+// checkConfigTimeouts returns an error if any script in cfg, which may be
+// nil, has a hard_timeout but no timeout of its own, and the hard timeout
+// isn't longer than timeout, the -timeout it would otherwise be sent SIGTERM
+// after.
+func checkConfigTimeouts(cfg *Config, timeout time.Duration) error {
+	if cfg == nil {
+		return nil
+	}
+	for name, sc := range cfg.Scripts {
+		if sc.HardTimeout > 0 && sc.Timeout == 0 && sc.HardTimeout <= timeout {
+			return fmt.Errorf("script '%s' has hard_timeout %v not longer than -timeout %v", name, sc.HardTimeout, timeout)
+		}
+	}
+	return nil
+}
+
+// merge returns sc with any zero-valued fields replaced by those in defaults.
+func (sc ScriptConfig) merge(defaults ScriptConfig) ScriptConfig {
+	if sc.Workdir == "" {
+		sc.Workdir = defaults.Workdir
+	}
+	if !sc.WorkdirFromScript {
+		sc.WorkdirFromScript = defaults.WorkdirFromScript
+	}
+	if sc.User == "" {
+		sc.User = defaults.User
+	}
+	if sc.Group == "" {
+		sc.Group = defaults.Group
+	}
+	if sc.MetricPrefix == "" {
+		sc.MetricPrefix = defaults.MetricPrefix
+	}
+	if !sc.VerboseErrors {
+		sc.VerboseErrors = defaults.VerboseErrors
+	}
+	if !sc.EmptyOutputIsError {
+		sc.EmptyOutputIsError = defaults.EmptyOutputIsError
+	}
+	if !sc.ServeOnExitError {
+		sc.ServeOnExitError = defaults.ServeOnExitError
+	}
+	if sc.SuccessRegex == "" {
+		sc.SuccessRegex = defaults.SuccessRegex
+		sc.successRe = defaults.successRe
+	}
+	if !sc.SuccessRegexDropMetrics {
+		sc.SuccessRegexDropMetrics = defaults.SuccessRegexDropMetrics
+	}
+	if sc.Interval == 0 {
+		sc.Interval = defaults.Interval
+	}
+	if sc.Jitter == 0 {
+		sc.Jitter = defaults.Jitter
+	}
+	if sc.KillGracePeriod == 0 {
+		sc.KillGracePeriod = defaults.KillGracePeriod
+	}
+	if sc.Timeout == 0 {
+		sc.Timeout = defaults.Timeout
+	}
+	if sc.HardTimeout == 0 {
+		sc.HardTimeout = defaults.HardTimeout
+	}
+	if !sc.ServeOnTimeout {
+		sc.ServeOnTimeout = defaults.ServeOnTimeout
+	}
+	if sc.SuccessExitCodes == nil {
+		sc.SuccessExitCodes = defaults.SuccessExitCodes
+	}
+	if sc.StderrIsError == nil {
+		sc.StderrIsError = defaults.StderrIsError
+	}
+	if sc.StderrLog == "" {
+		sc.StderrLog = defaults.StderrLog
+	}
+	if sc.Params == nil {
+		sc.Params = defaults.Params
+	}
+	if sc.PassHeaders == nil {
+		sc.PassHeaders = defaults.PassHeaders
+	}
+	if sc.RelabelConfigs == nil {
+		sc.RelabelConfigs = defaults.RelabelConfigs
+	}
+	if sc.Scale == nil {
+		sc.Scale = defaults.Scale
+	}
+	if sc.Labels == nil {
+		sc.Labels = defaults.Labels
+	}
+	if sc.LabelConflict == "" {
+		sc.LabelConflict = defaults.LabelConflict
+	}
+	if sc.OutputFile == "" {
+		sc.OutputFile = defaults.OutputFile
+	}
+	if !sc.RemoveOutputFile {
+		sc.RemoveOutputFile = defaults.RemoveOutputFile
+	}
+	if sc.ConcurrencyKey == "" {
+		sc.ConcurrencyKey = defaults.ConcurrencyKey
+	}
+	if sc.Workers == nil {
+		sc.Workers = defaults.Workers
+	}
+	if sc.TimeoutCommand == nil {
+		sc.TimeoutCommand = defaults.TimeoutCommand
+	}
+	if sc.FilterCommand == nil {
+		sc.FilterCommand = defaults.FilterCommand
+	}
+	if sc.ExpectedMetrics == nil {
+		sc.ExpectedMetrics = defaults.ExpectedMetrics
+	}
+	if !sc.MergeFamilies {
+		sc.MergeFamilies = defaults.MergeFamilies
+	}
+	if !sc.OpenTSDBQuantiles {
+		sc.OpenTSDBQuantiles = defaults.OpenTSDBQuantiles
+	}
+	if sc.Format == "" {
+		sc.Format = defaults.Format
+	}
+	if sc.Encoding == "" {
+		sc.Encoding = defaults.Encoding
+	}
+	if sc.Nice == 0 {
+		sc.Nice = defaults.Nice
+	}
+	if sc.IOClass == "" {
+		sc.IOClass = defaults.IOClass
+		sc.IOPriority = defaults.IOPriority
+	}
+	if sc.MemoryLimit == 0 {
+		sc.MemoryLimit = defaults.MemoryLimit
+	}
+	if sc.FileLimit == 0 {
+		sc.FileLimit = defaults.FileLimit
+	}
+	if sc.CPULimit == 0 {
+		sc.CPULimit = defaults.CPULimit
+	}
+	if sc.Repeat == 0 {
+		sc.Repeat = defaults.Repeat
+	}
+	if sc.Aggregate == "" {
+		sc.Aggregate = defaults.Aggregate
+	}
+	if sc.CircuitBreakerFailures == 0 {
+		sc.CircuitBreakerFailures = defaults.CircuitBreakerFailures
+	}
+	if sc.CircuitBreakerCooldown == 0 {
+		sc.CircuitBreakerCooldown = defaults.CircuitBreakerCooldown
+	}
+	return sc
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s MySuite) TestLoadConfig(c *C) {
+	f, err := ioutil.TempFile("", "script-exporter")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("scripts:\n  a:\n    workdir: /tmp\n  b:\n    workdir_from_script: true\n    success_exit_codes: [1, 2]\n")
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	cfg, err := LoadConfig(f.Name())
+	c.Assert(err, IsNil)
+	c.Check(cfg.Scripts["a"], DeepEquals, ScriptConfig{Workdir: "/tmp"})
+	c.Check(cfg.Scripts["b"], DeepEquals, ScriptConfig{WorkdirFromScript: true, SuccessExitCodes: []int{1, 2}})
+
+	defaults := ScriptConfig{Workdir: "/"}
+	c.Check(cfg.Scripts["a"].merge(defaults).Workdir, Equals, "/tmp")
+	c.Check(cfg.Scripts["b"].merge(defaults).Workdir, Equals, "/")
+	c.Check(cfg.Scripts["c"].merge(defaults).Workdir, Equals, "/")
+
+	c.Check(cfg.Routes, HasLen, 0)
+	script, _, ok := cfg.route("/metrics/a")
+	c.Check(ok, Equals, false)
+	c.Check(script, Equals, "")
+
+	// Unknown fields are rejected.
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("scripts:\n  a:\n    wrkdir: /tmp\n"), 0644), IsNil)
+	_, err = LoadConfig(f.Name())
+	c.Check(err, Not(IsNil))
+
+	// As are invalid metric prefixes.
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("scripts:\n  a:\n    metric_prefix: disk.\n"), 0644), IsNil)
+	_, err = LoadConfig(f.Name())
+	c.Check(err, Not(IsNil))
+
+	// As are routes with invalid regexps.
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("routes:\n- path: '^/metrics/(a'\n  script: a\n"), 0644), IsNil)
+	_, err = LoadConfig(f.Name())
+	c.Check(err, Not(IsNil))
+
+	// stderr_is_error may be explicitly false, unlike other booleans.
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("scripts:\n  a:\n    stderr_is_error: false\n    stderr_log: summary\n"), 0644), IsNil)
+	cfg, err = LoadConfig(f.Name())
+	c.Assert(err, IsNil)
+	c.Check(cfg.Scripts["a"].stderrIsError(), Equals, false)
+	yes := true
+	c.Check(cfg.Scripts["a"].merge(ScriptConfig{StderrIsError: &yes}).stderrIsError(), Equals, false)
+	c.Check(cfg.Scripts["b"].merge(ScriptConfig{StderrIsError: &yes}).stderrIsError(), Equals, true)
+	c.Check(cfg.Scripts["b"].stderrIsError(), Equals, true)
+
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("scripts:\n  a:\n    stderr_log: everything\n"), 0644), IsNil)
+	_, err = LoadConfig(f.Name())
+	c.Check(err, Not(IsNil))
+
+	// Label names must be valid and not reserved.
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("scripts:\n  a:\n    labels:\n      __name__: x\n"), 0644), IsNil)
+	_, err = LoadConfig(f.Name())
+	c.Check(err, Not(IsNil))
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("scripts:\n  a:\n    labels:\n      dc: x\n    label_conflict: ignore\n"), 0644), IsNil)
+	_, err = LoadConfig(f.Name())
+	c.Check(err, Not(IsNil))
+
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("scripts:\n  a:\n    interval: 1m\n    jitter: 1.5\n"), 0644), IsNil)
+	_, err = LoadConfig(f.Name())
+	c.Check(err, Not(IsNil))
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("scripts:\n  a:\n    pass_headers: [Proxy]\n"), 0644), IsNil)
+	_, err = LoadConfig(f.Name())
+	c.Check(err, Not(IsNil))
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("scripts:\n  a:\n    repeat: 3\n    aggregate: median\n"), 0644), IsNil)
+	_, err = LoadConfig(f.Name())
+	c.Check(err, Not(IsNil))
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("scripts:\n  a:\n    format: json\n"), 0644), IsNil)
+	_, err = LoadConfig(f.Name())
+	c.Check(err, Not(IsNil))
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("scripts:\n  a:\n    encoding: ebcdic\n"), 0644), IsNil)
+	_, err = LoadConfig(f.Name())
+	c.Check(err, Not(IsNil))
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("scripts:\n  a:\n    timeout: 10s\n    hard_timeout: 5s\n"), 0644), IsNil)
+	_, err = LoadConfig(f.Name())
+	c.Check(err, Not(IsNil))
+
+	// Only scheduled scripts can push to a Pushgateway.
+	c.Assert(ioutil.WriteFile(f.Name(), []byte("scripts:\n  a:\n    pushgateway_url: http://pgw:9091\n"), 0644), IsNil)
+	_, err = LoadConfig(f.Name())
+	c.Check(err, Not(IsNil))
+}
+
+func (s MySuite) TestCheckConfigTimeouts(c *C) {
+	c.Check(checkConfigTimeouts(nil, time.Minute), IsNil)
+	cfg := &Config{Scripts: map[string]ScriptConfig{
+		"own":    {Timeout: 5 * time.Second, HardTimeout: 10 * time.Second},
+		"longer": {HardTimeout: 2 * time.Minute},
+	}}
+	c.Check(checkConfigTimeouts(cfg, time.Minute), IsNil)
+
+	// Without its own timeout, the hard timeout is compared to -timeout.
+	cfg.Scripts["shorter"] = ScriptConfig{HardTimeout: 30 * time.Second}
+	c.Check(checkConfigTimeouts(cfg, time.Minute), ErrorMatches, "script 'shorter' has hard_timeout 30s not longer than -timeout 1m0s")
+}
+
+func (s MySuite) TestConfigRoutes(c *C) {
+	f, err := ioutil.TempFile("", "script-exporter")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`routes:
+- path: '^/metrics/node/(\w+)$'
+  script: node.sh
+- path: '^/metrics/disk/(?P<dev>\w+)/(\w+)$'
+  script: disk.sh
+  args: ["--device=${dev}", "--stat", "$2"]
+- path: '^/metrics/node/'
+  script: unreachable.sh
+`)
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	cfg, err := LoadConfig(f.Name())
+	c.Assert(err, IsNil)
+
+	// The first matching route wins.
+	script, args, ok := cfg.route("/metrics/node/cpu")
+	c.Check(ok, Equals, true)
+	c.Check(script, Equals, "node.sh")
+	c.Check(args, DeepEquals, []string{"cpu"})
+
+	script, args, ok = cfg.route("/metrics/disk/sda/io")
+	c.Check(ok, Equals, true)
+	c.Check(script, Equals, "disk.sh")
+	c.Check(args, DeepEquals, []string{"--device=sda", "--stat", "io"})
+
+	_, _, ok = cfg.route("/metrics/other")
+	c.Check(ok, Equals, false)
+}
+
+func (s MySuite) TestLoadConfigFormats(c *C) {
+	dir, err := ioutil.TempDir("", "script-exporter")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	want := ScriptConfig{Workdir: "/tmp", KillGracePeriod: 5 * time.Second, SuccessExitCodes: []int{1}}
+	for name, content := range map[string]string{
+		"config.yml":  "scripts:\n  a:\n    workdir: /tmp\n    kill_grace_period: 5s\n    success_exit_codes: [1]\n",
+		"config.json": `{"scripts": {"a": {"workdir": "/tmp", "kill_grace_period": "5s", "success_exit_codes": [1]}}}`,
+		"config.toml": "[scripts.a]\nworkdir = \"/tmp\"\nkill_grace_period = \"5s\"\nsuccess_exit_codes = [1]\n",
+	} {
+		filename := path.Join(dir, name)
+		c.Assert(ioutil.WriteFile(filename, []byte(content), 0644), IsNil)
+		cfg, err := LoadConfig(filename)
+		c.Assert(err, IsNil, Commentf("%s", name))
+		c.Check(cfg.Scripts["a"], DeepEquals, want, Commentf("%s", name))
+	}
+
+	// Unknown fields are rejected whatever the format.
+	for name, content := range map[string]string{
+		"bad.json": `{"scripts": {"a": {"wrkdir": "/tmp"}}}`,
+		"bad.toml": "[scripts.a]\nwrkdir = \"/tmp\"\n",
+	} {
+		filename := path.Join(dir, name)
+		c.Assert(ioutil.WriteFile(filename, []byte(content), 0644), IsNil)
+		_, err := LoadConfig(filename)
+		c.Check(err, Not(IsNil), Commentf("%s", name))
+	}
+}
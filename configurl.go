@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// configFetchTimeout limits how long fetching a config from a URL may take.
+const configFetchTimeout = 10 * time.Second
+
+// fetchConfigURL returns the content served at u.
+func fetchConfigURL(u string) ([]byte, error) {
+	client := &http.Client{Timeout: configFetchTimeout}
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch config from '%s': %v", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch config from '%s': %s", u, resp.Status)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch config from '%s': %v", u, err)
+	}
+	return content, nil
+}
+
+// parseConfigURL parses content fetched from u.  As with files, the
+// extension of u's path decides whether it's TOML.
+func parseConfigURL(content []byte, u string) (*Config, error) {
+	source := u
+	if parsed, err := url.Parse(u); err == nil {
+		source = parsed.Path
+	}
+	cfg, err := parseConfig(content, source)
+	if err != nil {
+		return nil, fmt.Errorf("from '%s': %v", u, err)
+	}
+	return cfg, nil
+}
+
+// LoadConfigURL fetches and parses the config served at u.
+func LoadConfigURL(u string) (*Config, error) {
+	content, err := fetchConfigURL(u)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfigURL(content, u)
+}
+
+// loadConfigURLWithRetry calls LoadConfigURL up to attempts times, waiting
+// backoff after the first failure and doubling the wait after each
+// subsequent one.  It returns the last error if every attempt fails.
+func loadConfigURLWithRetry(u string, attempts int, backoff time.Duration) (*Config, error) {
+	var err error
+	for i := 0; i < attempts; i++ {
+		var cfg *Config
+		if cfg, err = LoadConfigURL(u); err == nil {
+			return cfg, nil
+		}
+		if i < attempts-1 {
+			warnf("Error loading config, retrying in %v: %v", backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return nil, err
+}
+
+// pollConfigURL fetches the config served at u every interval until done is
+// closed, calling apply with it whenever it has changed.  Errors are logged,
+// leaving the config last applied in place.
+func pollConfigURL(u string, interval time.Duration, done <-chan struct{}, apply func(*Config)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last []byte
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		content, err := fetchConfigURL(u)
+		if err != nil {
+			errorf("Error polling config: %v", err)
+			continue
+		}
+		if last != nil && bytes.Equal(content, last) {
+			continue
+		}
+		cfg, err := parseConfigURL(content, u)
+		if err != nil {
+			errorf("Error polling config: %v", err)
+			continue
+		}
+		last = content
+		apply(cfg)
+	}
+}
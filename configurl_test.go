@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s MySuite) TestLoadConfigURL(c *C) {
+	var mtx sync.Mutex
+	content := "scripts:\n  a:\n    verbose_errors: true\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if r.URL.Path != "/config.yml" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer srv.Close()
+
+	cfg, err := LoadConfigURL(srv.URL + "/config.yml")
+	c.Assert(err, IsNil)
+	c.Check(cfg.Scripts["a"].VerboseErrors, Equals, true)
+
+	_, err = LoadConfigURL(srv.URL + "/missing.yml")
+	c.Check(err, Not(IsNil))
+	_, err = loadConfigURLWithRetry(srv.URL+"/missing.yml", 2, time.Millisecond)
+	c.Check(err, Not(IsNil))
+
+	done := make(chan struct{})
+	defer close(done)
+	applied := make(chan *Config, 10)
+	go pollConfigURL(srv.URL+"/config.yml", 10*time.Millisecond, done, func(cfg *Config) {
+		applied <- cfg
+	})
+	select {
+	case cfg = <-applied:
+		c.Check(cfg.Scripts["a"].VerboseErrors, Equals, true)
+	case <-time.After(5 * time.Second):
+		c.Fatal("config not polled")
+	}
+
+	// An invalid config is ignored; a valid change is applied.
+	mtx.Lock()
+	content = "scripts: [\n"
+	mtx.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	mtx.Lock()
+	content = "scripts:\n  b:\n    metric_prefix: b\n"
+	mtx.Unlock()
+	select {
+	case cfg = <-applied:
+		c.Check(cfg.Scripts["b"].MetricPrefix, Equals, "b")
+	case <-time.After(5 * time.Second):
+		c.Fatal("updated config not applied")
+	}
+}
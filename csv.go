@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// csvContentType is the media type of metrics rendered by writeCSV.
+const csvContentType = "text/csv"
+
+// acceptsCSV returns true if r's Accept header asks for text/csv.
+func acceptsCSV(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accept); err == nil && mediaType == csvContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// serveMetrics serves the metrics gathered by g as promhttp.HandlerFor(g, opts)
+// would, except that requests accepting text/csv get them as CSV.
+func serveMetrics(w http.ResponseWriter, r *http.Request, g prometheus.Gatherer, opts promhttp.HandlerOpts) {
+	if !acceptsCSV(r) {
+		promhttp.HandlerFor(g, opts).ServeHTTP(w, r)
+		return
+	}
+	fams, err := g.Gather()
+	if err != nil {
+		if opts.ErrorHandling != promhttp.ContinueOnError {
+			http.Error(w, fmt.Sprintf("An error has occurred during metrics gathering:\n\n%v", err),
+				http.StatusInternalServerError)
+			return
+		}
+		errorf("error gathering metrics: %v", err)
+	}
+	w.Header().Set("Content-Type", csvContentType+"; charset=utf-8")
+	if err := writeCSV(w, fams); err != nil {
+		errorf("error writing CSV metrics: %v", err)
+	}
+}
+
+// writeCSV writes fams to w as CSV with a header and then a row per sample,
+// giving its name, its labels in the text exposition format, and its value.
+// Histograms and summaries are split into samples as in the text format.
+func writeCSV(w io.Writer, fams []*dto.MetricFamily) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "labels", "value"})
+	for _, fam := range fams {
+		name := fam.GetName()
+		for _, m := range fam.Metric {
+			row := func(suffix string, value float64, extra ...string) {
+				cw.Write([]string{name + suffix, csvLabels(m.Label, extra...), csvValue(value)})
+			}
+			switch fam.GetType() {
+			case dto.MetricType_COUNTER:
+				row("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				row("", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				row("", m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.Quantile {
+					row("", q.GetValue(), "quantile", csvValue(q.GetQuantile()))
+				}
+				row("_sum", s.GetSampleSum())
+				row("_count", float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				infSeen := false
+				for _, b := range h.Bucket {
+					if math.IsInf(b.GetUpperBound(), +1) {
+						infSeen = true
+					}
+					row("_bucket", float64(b.GetCumulativeCount()), "le", csvValue(b.GetUpperBound()))
+				}
+				if !infSeen {
+					row("_bucket", float64(h.GetSampleCount()), "le", "+Inf")
+				}
+				row("_sum", h.GetSampleSum())
+				row("_count", float64(h.GetSampleCount()))
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// labelEscaper escapes label values as the text exposition format does.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// csvLabels formats labels, followed by the name/value pairs in extra, as
+// they appear between the braces of the text exposition format.
+func csvLabels(labels []*dto.LabelPair, extra ...string) string {
+	pairs := make([]string, 0, len(labels)+len(extra)/2)
+	for _, lp := range labels {
+		pairs = append(pairs, lp.GetName()+`="`+labelEscaper.Replace(lp.GetValue())+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// csvValue formats v as the text exposition format does.
+func csvValue(v float64) string {
+	switch {
+	case math.IsInf(v, +1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
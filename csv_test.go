@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s MySuite) TestWriteCSV(c *C) {
+	g, _, err := parseText(parseOpts{}, `# TYPE req counter
+req{path="/a",code="200"} 3
+req{path="/\"b\"",code="500"} 1
+# TYPE lat histogram
+lat_bucket{le="0.5"} 2
+lat_bucket{le="+Inf"} 3
+lat_sum 1.25
+lat_count 3
+`)
+	c.Assert(err, IsNil)
+	fams, err := g.Gather()
+	c.Assert(err, IsNil)
+
+	var buf bytes.Buffer
+	c.Assert(writeCSV(&buf, fams), IsNil)
+	c.Check(buf.String(), Equals, `name,labels,value
+lat_bucket,"le=""0.5""",2
+lat_bucket,"le=""+Inf""",3
+lat_sum,,1.25
+lat_count,,3
+req,"code=""200"",path=""/a""",3
+req,"code=""500"",path=""/\""b\""""",1
+`)
+}
+
+func (s MySuite) TestServeHTTPCSV(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"tabular": "#!/bin/sh\necho 'rows{table=\"t\"} 4'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{}, nil)
+	go sh.Start()
+
+	r := httptest.NewRequest("GET", "/metrics/tabular", nil)
+	r.Header.Set("Accept", "text/csv;q=0.9, text/plain")
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, r)
+	c.Check(w.Code, Equals, 200)
+	c.Check(w.Header().Get("Content-Type"), Equals, "text/csv; charset=utf-8")
+	c.Check(w.Body.String(), Matches, `(?s)name,labels,value\n.*rows,"table=""t""",4\n.*`)
+
+	// Other requests get the usual exposition format.
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/tabular", nil))
+	c.Check(w.Header().Get("Content-Type"), Not(Equals), "text/csv; charset=utf-8")
+	c.Check(w.Body.String(), Matches, `(?s).*\nrows{table="t"} 4\n.*`)
+}
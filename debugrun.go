@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// debugRunHandler returns a handler which runs the script named by the part
+// of the request path following prefix, subject to the same timeout and
+// concurrency limit as a scrape, and responds with what it wrote to stdout
+// and stderr without attempting to parse it.  Scheduled scripts are run
+// afresh rather than served from the cache.
+func (sh *ScriptHandler) debugRunHandler(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		script := strings.TrimPrefix(r.URL.Path, prefix)
+		if script == "" || !validScriptPath(script) {
+			http.Error(w, fmt.Sprintf("invalid script path '%s'", script), http.StatusBadRequest)
+			return
+		}
+		var args []string
+		if sh.pathArgs {
+			segs := strings.Split(script, "/")
+			script, args = segs[0], segs[1:]
+		}
+
+		id := newRequestID()
+		cargs, err := sh.scriptConfig(script).renderArgs(r.URL.Query())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad request for script '%s' (request id %s): %v", script, id, err),
+				http.StatusBadRequest)
+			return
+		}
+		result := sh.runScript(r.Context(), id, script, sh.scriptConfig(script).headerEnv(r.Header), append(cargs, args...)...)
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "request id: %s\n", id)
+		if result.err != nil {
+			fmt.Fprintf(w, "error: %v\n", result.err)
+		}
+		fmt.Fprintf(w, "--- stdout ---\n%s", result.output)
+		fmt.Fprintf(w, "--- stderr ---\n%s", result.stderr)
+	})
+}
+
+// validScriptPath returns false if script, a path relative to the script
+// directory, tries to escape it.
+func validScriptPath(script string) bool {
+	for _, seg := range strings.Split(script, "/") {
+		if seg == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// basicAuth returns a handler which passes requests on to h only if they
+// give user and password using HTTP basic authentication.
+func basicAuth(h http.Handler, user, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="script-exporter"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// readAuthFile returns the user and password given in filename, which must
+// contain them as "user:password".
+func readAuthFile(filename string) (string, string, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.SplitN(strings.TrimSpace(string(content)), ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("'%s' doesn't contain user:password", filename)
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s MySuite) TestDebugRunHandler(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"garbled": "#!/bin/sh\necho 'not { metrics'\necho oops >&2\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{}, nil)
+	go sh.Start()
+	h := basicAuth(sh.debugRunHandler("/debug/run/"), "admin", "secret")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/debug/run/garbled", nil))
+	c.Check(w.Code, Equals, 401)
+
+	r := httptest.NewRequest("GET", "/debug/run/garbled", nil)
+	r.SetBasicAuth("admin", "wrong")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	c.Check(w.Code, Equals, 401)
+
+	r = httptest.NewRequest("GET", "/debug/run/garbled", nil)
+	r.SetBasicAuth("admin", "secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	c.Check(w.Code, Equals, 200)
+	c.Check(w.Header().Get("Content-Type"), Equals, "text/plain; charset=utf-8")
+	c.Check(w.Body.String(), Matches, `(?s).*--- stdout ---\nnot \{ metrics\n--- stderr ---\noops\n`)
+
+	r = httptest.NewRequest("GET", "/debug/run/../garbled", nil)
+	r.SetBasicAuth("admin", "secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	c.Check(w.Code, Equals, 400)
+}
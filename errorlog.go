@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of errors kept for each script by a scriptErrorLog.
+	errorLogSize = 10
+	// Maximum number of bytes of stderr kept for each error, or shown in
+	// an error response.
+	errorLogMaxStderr = 1024
+)
+
+// A scriptErrorEntry describes one failed script invocation.
+type scriptErrorEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Error     string    `json:"error"`
+	// ExitCode is the script's exit status, or -1 if it didn't exit
+	// normally, e.g. because it was killed on timeout.
+	ExitCode int    `json:"exit_code"`
+	Stderr   string `json:"stderr"`
+}
+
+// truncateStderr returns the last errorLogMaxStderr bytes of stderr, which
+// are the most likely to explain a failure.
+func truncateStderr(stderr string) string {
+	if len(stderr) > errorLogMaxStderr {
+		return "..." + stderr[len(stderr)-errorLogMaxStderr:]
+	}
+	return stderr
+}
+
+// scriptErrorLog keeps the most recent errors for each script, so that they
+// can be inspected over HTTP.  Memory use is bounded by keeping only the last
+// errorLogSize errors per script, and truncating their stderr.
+type scriptErrorLog struct {
+	mtx     sync.Mutex
+	entries map[string][]scriptErrorEntry
+}
+
+func newScriptErrorLog() *scriptErrorLog {
+	return &scriptErrorLog{entries: make(map[string][]scriptErrorEntry)}
+}
+
+// add records e as the most recent error for script, discarding the oldest
+// one if the script already has errorLogSize of them.
+func (el *scriptErrorLog) add(script string, e scriptErrorEntry) {
+	e.Stderr = truncateStderr(e.Stderr)
+
+	el.mtx.Lock()
+	defer el.mtx.Unlock()
+	entries := el.entries[script]
+	if len(entries) >= errorLogSize {
+		copy(entries, entries[1:])
+		entries = entries[:len(entries)-1]
+	}
+	el.entries[script] = append(entries, e)
+}
+
+// ServeHTTP implements http.Handler.  It responds with a JSON object mapping
+// script names to their recent errors, oldest first.
+func (el *scriptErrorLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	el.mtx.Lock()
+	out, err := json.MarshalIndent(el.entries, "", "  ")
+	el.mtx.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
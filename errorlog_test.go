@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s MySuite) TestScriptErrorLog(c *C) {
+	el := newScriptErrorLog()
+	for i := 0; i < errorLogSize+2; i++ {
+		el.add("a", scriptErrorEntry{Error: fmt.Sprint(i), ExitCode: 1})
+	}
+	el.add("b", scriptErrorEntry{Error: "b", Stderr: strings.Repeat("x", errorLogMaxStderr) + "y"})
+
+	w := httptest.NewRecorder()
+	el.ServeHTTP(w, httptest.NewRequest("GET", "/debug/script-errors", nil))
+	c.Assert(w.Code, Equals, 200)
+	var got map[string][]scriptErrorEntry
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &got), IsNil)
+
+	// Only the most recent errors are kept, oldest first.
+	c.Assert(len(got["a"]), Equals, errorLogSize)
+	c.Check(got["a"][0].Error, Equals, "2")
+	c.Check(got["a"][errorLogSize-1].Error, Equals, fmt.Sprint(errorLogSize+1))
+
+	// Long stderr output is truncated, keeping the end.
+	c.Assert(len(got["b"]), Equals, 1)
+	c.Check(got["b"][0].Stderr, Equals, "..."+strings.Repeat("x", errorLogMaxStderr-1)+"y")
+}
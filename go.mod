@@ -4,6 +4,7 @@ go 1.12
 
 require (
 	bosun.org v0.0.0-20161109002104-b585c890132e
+	github.com/BurntSushi/toml v0.3.1
 	github.com/beorn7/perks v0.0.0-20150223135152-b965b613227f // indirect
 	github.com/golang/protobuf v0.0.0-20160211013955-0dfe8f37844c // indirect
 	github.com/matttproud/golang_protobuf_extensions v0.0.0-20151011102529-d0c3fe89de86 // indirect
@@ -13,4 +14,5 @@ require (
 	github.com/prometheus/procfs v0.0.0-20151029195050-406e5b7bfd82 // indirect
 	golang.org/x/sys v0.0.0-20190726091711-fc99dfbffb4e // indirect
 	gopkg.in/check.v1 v1.0.0-20161208181325-20d25e280405
+	gopkg.in/yaml.v2 v2.2.8
 )
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// A logLevel is the severity of a log message.  Messages below the level set
+// by -log.level aren't logged.
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// minLevel is the level of the least severe messages logged.
+var minLevel = int32(levelInfo)
+
+// parseLogLevel returns the level named s, as given to -log.level.
+func parseLogLevel(s string) (logLevel, error) {
+	level, ok := levelNames[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level '%s', expected debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// setLogLevel sets the level of the least severe messages logged.
+func setLogLevel(level logLevel) {
+	atomic.StoreInt32(&minLevel, int32(level))
+}
+
+// logEnabled returns true if messages at level are logged.
+func logEnabled(level logLevel) bool {
+	return int32(level) >= atomic.LoadInt32(&minLevel)
+}
+
+// logf logs a message at level, formatted as by log.Printf.
+func logf(level logLevel, format string, args ...interface{}) {
+	if logEnabled(level) {
+		log.Printf(format, args...)
+	}
+}
+
+func debugf(format string, args ...interface{}) { logf(levelDebug, format, args...) }
+func infof(format string, args ...interface{})  { logf(levelInfo, format, args...) }
+func warnf(format string, args ...interface{})  { logf(levelWarn, format, args...) }
+func errorf(format string, args ...interface{}) { logf(levelError, format, args...) }
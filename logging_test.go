@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s MySuite) TestLogLevel(c *C) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer setLogLevel(levelInfo)
+
+	level, err := parseLogLevel("warn")
+	c.Assert(err, IsNil)
+	setLogLevel(level)
+	debugf("debug")
+	infof("info")
+	warnf("warn")
+	errorf("error")
+	c.Check(buf.String(), Matches, "(?s)[^\n]*warn\n[^\n]*error\n")
+
+	_, err = parseLogLevel("verbose")
+	c.Check(err, Not(IsNil))
+
+	// At debug level every scrape is logged.
+	buf.Reset()
+	setLogLevel(levelDebug)
+	recordOutcome("abcd", "loglevel", runresult{output: "a 1\n", args: []string{"x"}}, false)
+	c.Check(buf.String(), Matches, `.*\[abcd\] scrape script="loglevel" args=\["x"\] duration=0s output_bytes=4 outcome=success\n`)
+}
@@ -3,53 +3,311 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
+	mrand "math/rand"
+	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"net/http/pprof"
+	"os"
+	"os/signal"
 	"path"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/model"
 )
 
+// Build information, populated at build time via -ldflags.
 var (
+	version = "unknown"
+	commit  = "unknown"
+)
+
+// The exporter's own metrics, created by newMetrics.
+var (
+	mStartTime        prometheus.Gauge
+	mBuildInfo        *prometheus.GaugeVec
+	mDuration         *prometheus.CounterVec
+	mConcExceeds      *prometheus.CounterVec
+	mRuns             *prometheus.CounterVec
+	mErrors           *prometheus.CounterVec
+	mParseErrors      *prometheus.CounterVec
+	mTimeouts         *prometheus.CounterVec
+	mRunning          *prometheus.GaugeVec
+	mQueueDepth       *prometheus.GaugeVec
+	mRequestsRejected prometheus.Counter
+	mDataAge          *prometheus.GaugeVec
+	mEmptyOutput      *prometheus.CounterVec
+	mConcAvailable    *prometheus.GaugeVec
+	mPushErrors       *prometheus.CounterVec
+	mTimeseries       *prometheus.GaugeVec
+	mSpawnErrors      *prometheus.CounterVec
+	mFilterErrors     *prometheus.CounterVec
+	mSkippedLines     *prometheus.CounterVec
+	mCacheServedAge   *prometheus.GaugeVec
+	mCacheServed      *prometheus.GaugeVec
+	mParseDuration    *prometheus.HistogramVec
+	mSchemaViolations *prometheus.CounterVec
+	mConfigTimeout    *prometheus.GaugeVec
+	mConfigWorkers    *prometheus.GaugeVec
+	mParseErrorInfo   *prometheus.GaugeVec
+	mScrapeOutcomes   *prometheus.CounterVec
+	mCircuitOpen      *prometheus.CounterVec
+	mDisabledRequests *prometheus.CounterVec
+	mCopiesStarted    prometheus.Counter
+	mCopiesFinished   prometheus.Counter
+	mCanceled         *prometheus.CounterVec
+	mDisconnects      *prometheus.CounterVec
+	mScriptFiles      prometheus.Gauge
+	mFilesChanged     prometheus.Counter
+
+	// Descriptions of the script_success metric added to the output of a single
+	// script and of /all respectively.
+	successDesc         *prometheus.Desc
+	successByScriptDesc *prometheus.Desc
+
+	// Descriptions of the script_duration_seconds metric added to the output
+	// of a single script and of /all respectively.
+	durationDesc         *prometheus.Desc
+	durationByScriptDesc *prometheus.Desc
+
+	cacheAgeDesc      *prometheus.Desc
+	textfileErrorDesc *prometheus.Desc
+)
+
+// defaultNamespace is the prefix of the names of the exporter's own metrics,
+// unless overridden by -metrics.namespace.
+const defaultNamespace = "script"
+
+func init() {
+	newMetrics(defaultNamespace)
+}
+
+// newMetrics creates the exporter's own metrics, with names prefixed by
+// namespace.  It's called with the default namespace at init, so that the
+// metrics are always usable, and again by main once flags are parsed,
+// before registerMetrics.
+func newMetrics(namespace string) {
+	mStartTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "exporter_start_time_seconds",
+		Help:      "unix time at which the exporter started",
+	})
+	mBuildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "exporter_build_info",
+		Help:      "constant 1, labelled with the version, revision and Go version the exporter was built from",
+	}, []string{"version", "revision", "goversion"})
 	mDuration = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "script_duration_seconds_total",
-		Help: "time elapsed executing script",
+		Namespace: namespace,
+		Name:      "duration_seconds_total",
+		Help:      "time elapsed executing script",
 	}, []string{"script_name"})
 	mConcExceeds = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "script_concurrency_exceeds_total",
-		Help: "number of times script was not executed because there were already too many executions ongoing",
+		Namespace: namespace,
+		Name:      "concurrency_exceeds_total",
+		Help:      "number of times script was not executed because there were already too many executions ongoing",
 	}, []string{"script_name"})
 	mRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "script_runs_total",
-		Help: "number of times script execution attempted",
+		Namespace: namespace,
+		Name:      "runs_total",
+		Help:      "number of times script execution attempted",
 	}, []string{"script_name"})
 	mErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "script_errors_total",
-		Help: "number of script executions that ended with an error",
+		Namespace: namespace,
+		Name:      "errors_total",
+		Help:      "number of script executions that ended with an error",
 	}, []string{"script_name"})
 	mParseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "script_parse_errors_total",
-		Help: "number of script executions that ended without error but produced unparseable output",
+		Namespace: namespace,
+		Name:      "parse_errors_total",
+		Help:      "number of script executions that ended without error but produced unparseable output",
 	}, []string{"script_name"})
 	mTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "script_timeouts_total",
-		Help: "number of script executions that were killed due to timeout",
+		Namespace: namespace,
+		Name:      "timeouts_total",
+		Help:      "number of script executions that were killed due to timeout",
 	}, []string{"script_name"})
 	mRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "script_running",
-		Help: "number of executions ongoing",
+		Namespace: namespace,
+		Name:      "running",
+		Help:      "number of executions ongoing",
+	}, []string{"script_name"})
+	mQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "number of requests to run script waiting to be dispatched or running",
+	}, []string{"script_name"})
+	mRequestsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "exporter_http_requests_rejected_total",
+		Help:      "number of HTTP requests rejected because -web.max-requests were already being handled",
+	})
+	mDataAge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "data_age_seconds",
+		Help:      "age of the oldest sample timestamp in the latest successfully parsed output of script, if it gave timestamps",
+	}, []string{"script_name"})
+	mEmptyOutput = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "empty_output_total",
+		Help:      "number of script executions that ended without error but wrote nothing but whitespace to stdout",
+	}, []string{"script_name"})
+	mConcAvailable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "concurrency_available",
+		Help:      "number of further executions of script which may be started before reaching the concurrency limit",
+	}, []string{"script_name"})
+	mPushErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "push_errors_total",
+		Help:      "number of times the output of a scheduled run couldn't be pushed to the Pushgateway",
+	}, []string{"script_name"})
+	mTimeseries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "timeseries",
+		Help:      "number of timeseries parsed from the output of the latest successfully parsed scrape",
+	}, []string{"script_name"})
+	mSpawnErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "spawn_errors_total",
+		Help:      "number of script executions that failed because the script couldn't be started, also counted as errors",
+	}, []string{"script_name"})
+	mFilterErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "filter_errors_total",
+		Help:      "number of script executions whose output the filter_command failed on, also counted as errors",
+	}, []string{"script_name"})
+	mSkippedLines = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "skipped_lines_total",
+		Help:      "number of lines of NDJSON output from script which couldn't be parsed and were left out",
+	}, []string{"script_name"})
+	mCacheServedAge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_served_age_seconds",
+		Help:      "age of the cached result of a scheduled script when it was last served",
+	}, []string{"script_name"})
+	mCacheServed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_served",
+		Help:      "1 if the latest scrape of script was served a cached result, 0 if the script was run for it",
 	}, []string{"script_name"})
-)
 
-func init() {
+	mParseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "parse_duration_seconds",
+		Help:      "time spent parsing successfully parsed script output",
+		Buckets:   []float64{.0001, .001, .01, .1, 1, 10},
+	}, []string{"script_name"})
+
+	mSchemaViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "schema_violation_total",
+		Help:      "number of times the metrics parsed from script's output didn't match its expected_metrics",
+	}, []string{"script_name"})
+
+	mConfigTimeout = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "config_timeout_seconds",
+		Help:      "timeout in effect for each script named in the config",
+	}, []string{"script_name"})
+	mConfigWorkers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "config_workers",
+		Help:      "maximum concurrent executions in effect for each script named in the config",
+	}, []string{"script_name"})
+
+	mParseErrorInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "parse_error_info",
+		Help:      "constant 1 for scripts whose latest output couldn't be parsed, labelled with the start of the error",
+	}, []string{"script_name", "error"})
+	mScrapeOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scrape_outcome_total",
+		Help:      "number of scrapes of script, by outcome",
+	}, []string{"script_name", "outcome"})
+	mCircuitOpen = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "circuit_open_total",
+		Help:      "number of requests to run script answered with its latest failure because its circuit breaker was open",
+	}, []string{"script_name"})
+	mDisabledRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "disabled_requests_total",
+		Help:      "number of requests to run script refused because its workers setting is 0",
+	}, []string{"script_name"})
+	mCanceled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "canceled_total",
+		Help:      "number of script executions stopped because the request they were run for was canceled, e.g. by the client disconnecting",
+	}, []string{"script_name"})
+	mDisconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "client_disconnects_total",
+		Help:      "number of scrapes of script abandoned by the client disconnecting before the response",
+	}, []string{"script_name"})
+	mScriptFiles = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "files",
+		Help:      "number of executable files under -script.path, as of the latest check with -script.watch-interval",
+	})
+	mFilesChanged = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "files_changed_total",
+		Help:      "number of times an executable file under -script.path was found to have been added, removed or modified",
+	})
+	mCopiesStarted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "exporter_copy_goroutines_started_total",
+		Help:      "number of goroutines started to copy the stdout or stderr of a command",
+	})
+	mCopiesFinished = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "exporter_copy_goroutines_finished_total",
+		Help:      "number of goroutines copying the stdout or stderr of a command which have returned; less than the number started only while commands are running, unless they leak",
+	})
+
+	successDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "success"),
+		"whether the script ran successfully and its output could be parsed",
+		nil, nil)
+	successByScriptDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "success"),
+		"whether the script ran successfully and its output could be parsed",
+		[]string{"script_name"}, nil)
+	durationDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "duration_seconds"),
+		"how long the run of the script whose output is served took",
+		nil, nil)
+	durationByScriptDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "duration_seconds"),
+		"how long the run of the script whose output is served took",
+		[]string{"script_name"}, nil)
+	cacheAgeDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "cache_age_seconds"),
+		"time since the cached result of a scheduled script was produced",
+		[]string{"script_name"}, nil)
+	textfileErrorDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "textfile_scrape_error"),
+		"1 if there was an error reading or parsing the textfile, 0 otherwise",
+		[]string{"file"}, nil)
+}
+
+// registerMetrics registers the metrics created by newMetrics with the
+// default registry.
+func registerMetrics() {
+	prometheus.MustRegister(mStartTime)
+	prometheus.MustRegister(mBuildInfo)
 	prometheus.MustRegister(mDuration)
 	prometheus.MustRegister(mConcExceeds)
 	prometheus.MustRegister(mRuns)
@@ -57,32 +315,124 @@ func init() {
 	prometheus.MustRegister(mParseErrors)
 	prometheus.MustRegister(mTimeouts)
 	prometheus.MustRegister(mRunning)
+	prometheus.MustRegister(mQueueDepth)
+	prometheus.MustRegister(mTimeseries)
+	prometheus.MustRegister(mPushErrors)
+	prometheus.MustRegister(mConcAvailable)
+	prometheus.MustRegister(mEmptyOutput)
+	prometheus.MustRegister(mDataAge)
+	prometheus.MustRegister(mRequestsRejected)
+	prometheus.MustRegister(mCacheServedAge)
+	prometheus.MustRegister(mCacheServed)
+	prometheus.MustRegister(mSpawnErrors)
+	prometheus.MustRegister(mFilterErrors)
+	prometheus.MustRegister(mSkippedLines)
+	prometheus.MustRegister(mParseDuration)
+	prometheus.MustRegister(mSchemaViolations)
+	prometheus.MustRegister(mConfigTimeout)
+	prometheus.MustRegister(mConfigWorkers)
+	prometheus.MustRegister(mParseErrorInfo)
+	prometheus.MustRegister(mScrapeOutcomes)
+	prometheus.MustRegister(mCircuitOpen)
+	prometheus.MustRegister(mDisabledRequests)
+	prometheus.MustRegister(mCopiesStarted)
+	prometheus.MustRegister(mCopiesFinished)
+	prometheus.MustRegister(mCanceled)
+	prometheus.MustRegister(mDisconnects)
+	prometheus.MustRegister(mScriptFiles)
+	prometheus.MustRegister(mFilesChanged)
+
+	mStartTime.Set(float64(time.Now().Unix()))
+	mBuildInfo.WithLabelValues(version, commit, runtime.Version()).Set(1)
 }
 
 // A runresult describes the result of executing a script.
 type runresult struct {
 	// Stdout of script invocation.  Any stderr output results in an error.
 	output string
+	// Stderr of script invocation.
+	stderr string
 	// Error resulting from script invocation, or nil.
 	err error
+	// Stdout of every invocation, if the script was run more than once;
+	// output is then that of the last.
+	runs []string
+	// True if this is the cached result of a scheduled run.
+	cached bool
+	// How long the script ran for, in total if it was run more than once.
+	duration time.Duration
+	// Arguments the script was run with.
+	args []string
+}
+
+// A disabledError is the error in the result of a request to run a script
+// whose workers setting is 0.
+type disabledError struct {
+	script string
+}
+
+func (e disabledError) Error() string {
+	return fmt.Sprintf("script '%s' is disabled", e.script)
+}
+
+// checkEnabled returns a disabledError, and counts the request in
+// script_disabled_requests_total, if script is disabled.
+func (sh *ScriptHandler) checkEnabled(id, script string) error {
+	if sh.workersFor(script) != 0 {
+		return nil
+	}
+	debugf("[%s] not running script '%s' as it's disabled", id, script)
+	mDisabledRequests.WithLabelValues(script).Inc()
+	return disabledError{script}
 }
 
+// A concurrencyError is the error in the result of a request to run a script
+// which was rejected because too many instances were already running.
+type concurrencyError struct {
+	msg string
+}
+
+func (e concurrencyError) Error() string {
+	return e.msg
+}
+
+// errNoSuccessMatch is the error in the result of a run of a script whose
+// output doesn't match its success_regex.
+var errNoSuccessMatch = fmt.Errorf("output doesn't match success_regex")
+
 // A runreq is a request to run a script and capture its output
 type runreq struct {
 	// Context to run in (allows for cancelling requests)
 	ctx context.Context
 
+	// ID of the HTTP request this runreq serves, for logging.
+	id string
+
 	// Script to run, relative to scriptPath.
 	script string
 
+	// Arguments to pass to script.
+	args []string
+
+	// Extra environment variables to give script, as "NAME=value".
+	env []string
+
+	// Timeout the script is run with, for logging.
+	timeout time.Duration
+
 	// Result of running script.
 	result chan runresult
+
+	// Key of the semaphore limiting concurrent invocations, set by Start.
+	// If byName is true, it's the script name, otherwise it includes args.
+	key    string
+	byName bool
 }
 
 // ScriptHandler is the core of this app.
 type ScriptHandler struct {
-	// if opentsdb is true, interpret script output as opentsdb text format instead of Prometheus'
-	opentsdb bool
+	// How to interpret script output as metrics.
+	parse parseOpts
 
 	// Prefix of request path to strip off
 	metricsPath string
@@ -99,24 +449,200 @@ type ScriptHandler struct {
 	// Max duration of any script invocation
 	timeout time.Duration
 
+	// Recent errors for each script.
+	errors *scriptErrorLog
+
+	// Settings applied to scripts that don't override them in config.
+	defaults ScriptConfig
+
+	// If hideSelfMetrics is true, a request naming no script gets a 404
+	// rather than the exporter's own metrics, which are served elsewhere.
+	hideSelfMetrics bool
+
+	// If pathArgs is true, only the first segment of the request path
+	// after metricsPath names the script, and the remaining segments are
+	// passed to it as arguments.
+	pathArgs bool
+
+	// If queue is true, a request to run a script which already has
+	// scriptWorkers invocations running waits for one of them to finish, up
+	// to the request's deadline, rather than failing immediately.
+	queue bool
+
+	// timeoutOffset is subtracted from the scrape timeout Prometheus sends
+	// to give the timeout of scripts run for the scrape, so that it gets a
+	// response before giving up.
+	timeoutOffset time.Duration
+
+	// If dispatcher is true, scriptPath is a single executable which runs
+	// every script, and is passed the script name as its first argument.
+	dispatcher bool
+
+	// If maxScripts is positive, at most that many scripts not named in the
+	// config are run, bounding the cardinality of the script_name label.
+	maxScripts int
+
+	// writeTimeout is the HTTP server's write timeout, which requests must
+	// complete within, or 0 if there's none.
+	writeTimeout time.Duration
+
+	// runner runs scripts, and is runCommand except in tests.
+	runner func(ctx context.Context, opts commandOpts, script string, args ...string) (string, error)
+
 	// mtx must be locked before modifying any fields below it (preceding
-	// fields are not supposed to be modifyied.)
-	mtx sync.Mutex
+	// fields are not supposed to be modifyied.)  Since they're read on
+	// every scrape but rarely modified, readers only take a read lock.
+	mtx sync.RWMutex
+
+	// Per-script settings, may be nil.  Use getConfig to read it.
+	config *Config
+
+	// Semaphores limiting concurrent invocations of each script to
+	// scriptWorkers, by script name, or by script name and arguments for
+	// scripts whose concurrency_key is args.  A running invocation holds a
+	// slot in its semaphore's channel.
+	slots map[string]*semaphore
+
+	// Latest results of scripts run on a schedule, by script name.
+	cache map[string]cachedResult
+
+	// The error label of the script_parse_error_info metric for scripts
+	// whose latest output couldn't be parsed, by script name.
+	parseErrors map[string]string
+
+	// Circuit breakers of scripts which have failed since they last
+	// succeeded, by script name.
+	breakers map[string]*breaker
+
+	// Scripts not named in the config which have been run, counting
+	// towards maxScripts.
+	unconfigured map[string]bool
 
-	// Count of running script invocations by script name.
-	numChildren map[string]int
+	// Arguments read from args files, by path.
+	argsFiles map[string]cachedArgs
 }
 
-func NewScriptHandler(metricsPath, scriptPath string, opentsdb bool, scriptWorkers int, timeout time.Duration) *ScriptHandler {
+// A semaphore limits concurrent invocations of a script, or of a script with
+// particular arguments.
+type semaphore struct {
+	slots chan struct{}
+
+	// refs counts the requests holding or waiting for a slot, so that
+	// semaphores keyed by arguments can be discarded once unused.
+	refs int
+}
+
+// A cachedResult is the result of a scheduled script run.
+type cachedResult struct {
+	runresult
+	// ID of the scheduled run, for logging.
+	id string
+	// When the run completed.
+	time time.Time
+}
+
+func NewScriptHandler(metricsPath, scriptPath string, parse parseOpts, scriptWorkers int, timeout time.Duration, defaults ScriptConfig, config *Config) *ScriptHandler {
 	return &ScriptHandler{
 		metricsPath:   metricsPath,
 		scriptPath:    scriptPath,
-		opentsdb:      opentsdb,
-		numChildren:   make(map[string]int),
+		parse:         parse,
+		slots:         make(map[string]*semaphore),
+		cache:         make(map[string]cachedResult),
+		parseErrors:   make(map[string]string),
+		breakers:      make(map[string]*breaker),
+		unconfigured:  make(map[string]bool),
+		argsFiles:     make(map[string]cachedArgs),
+		errors:        newScriptErrorLog(),
 		reqchan:       make(chan runreq),
 		scriptWorkers: scriptWorkers,
 		timeout:       timeout,
+		timeoutOffset: defaultTimeoutOffset,
+		defaults:      defaults,
+		config:        config,
+		runner:        runCommand,
+	}
+}
+
+// parseOpts returns the options to use when parsing the output of script.
+func (sh *ScriptHandler) parseOpts(script string) parseOpts {
+	opts := sh.parse
+	sc := sh.scriptConfig(script)
+	opts.prefix = sc.MetricPrefix
+	opts.labels = sc.Labels
+	opts.scale = sc.Scale
+	if len(sh.parse.labels) > 0 {
+		// Labels set for every script, such as the hostname label, are
+		// overridden by the script's own.
+		opts.labels = make(map[string]string, len(sh.parse.labels)+len(sc.Labels))
+		for k, v := range sh.parse.labels {
+			opts.labels[k] = v
+		}
+		for k, v := range sc.Labels {
+			opts.labels[k] = v
+		}
+	}
+	opts.labelsError = sc.LabelConflict == labelConflictError
+	opts.relabel = sc.RelabelConfigs
+	opts.emptyIsError = sc.EmptyOutputIsError
+	opts.mergeFamilies = sc.MergeFamilies
+	opts.quantiles = sc.OpenTSDBQuantiles
+	opts.latin1 = sc.Encoding == encodingLatin1
+	switch sc.Format {
+	case formatPrometheus:
+		opts.opentsdb = false
+	case formatOpenTSDB:
+		opts.opentsdb = true
+	case formatNDJSON:
+		opts.ndjson = true
+	}
+	return opts
+}
+
+// getConfig returns the current per-script settings, which may be nil.
+func (sh *ScriptHandler) getConfig() *Config {
+	sh.mtx.RLock()
+	defer sh.mtx.RUnlock()
+	return sh.config
+}
+
+// setConfig replaces the per-script settings.  Scripts which have an
+// interval configured are only started on their schedules by Start, so
+// changes to which scripts are scheduled won't take effect until restart.
+func (sh *ScriptHandler) setConfig(config *Config) {
+	if longest := sh.longestRunTime(config); sh.writeTimeout > 0 && longest+writeTimeoutMargin > sh.writeTimeout {
+		warnf("Scripts may now run for up to %v, leaving too little of -web.write-timeout %v to serve their output; restart to raise it", longest, sh.writeTimeout)
 	}
+	sh.mtx.Lock()
+	sh.config = config
+	sh.mtx.Unlock()
+	sh.recordConfig(config)
+}
+
+// recordConfig sets the metrics reporting the settings in effect for each
+// script named in config, which may be nil.
+func (sh *ScriptHandler) recordConfig(config *Config) {
+	mConfigTimeout.Reset()
+	mConfigWorkers.Reset()
+	if config == nil {
+		return
+	}
+	scripts := append([]string{}, config.AllScripts...)
+	for script := range config.Scripts {
+		scripts = append(scripts, script)
+	}
+	for _, script := range scripts {
+		mConfigTimeout.WithLabelValues(script).Set(sh.timeoutFor(script).Seconds())
+		mConfigWorkers.WithLabelValues(script).Set(float64(sh.workersFor(script)))
+	}
+}
+
+// scriptConfig returns the settings to use when running script.
+func (sh *ScriptHandler) scriptConfig(script string) ScriptConfig {
+	var sc ScriptConfig
+	if config := sh.getConfig(); config != nil {
+		sc = config.Scripts[script]
+	}
+	return sc.merge(sh.defaults)
 }
 
 // ServeHTTP implements http.Handler.  It handles incoming HTTP requests by
@@ -124,90 +650,1238 @@ func NewScriptHandler(metricsPath, scriptPath string, opentsdb bool, scriptWorke
 // script name, interpreting the output as metrics, then publishing the result
 // as a regular Prometheus metrics response.
 func (sh *ScriptHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	script := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, sh.metricsPath), "/")
-	if script == "" {
+	config := sh.getConfig()
+	script, args, routed := config.route(r.URL.Path)
+	if !routed {
+		script = strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, sh.metricsPath), "/")
+		if !validScriptPath(script) {
+			http.Error(w, fmt.Sprintf("invalid script path '%s'", script), http.StatusBadRequest)
+			return
+		}
+		if sh.pathArgs {
+			segs := strings.Split(script, "/")
+			script, args = segs[0], segs[1:]
+		}
+	}
+
+	if timeout := scrapeTimeout(r, sh.timeoutOffset); timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	if script == "" && sh.hideSelfMetrics {
+		http.NotFound(w, r)
+	} else if script == "" {
 		promhttp.Handler().ServeHTTP(w, r)
+	} else if script == "all" && config != nil && len(config.AllScripts) > 0 {
+		sh.serveAll(w, r, newRequestID(), config.AllScripts)
+	} else if !sh.knownScript(config, script) {
+		// Don't let requests for arbitrary names create timeseries.
+		http.Error(w, fmt.Sprintf("unknown script '%s'", script), http.StatusNotFound)
 	} else {
-		reschan := make(chan runresult)
-		ctx, cancel := context.WithDeadline(r.Context(), time.Now().Add(sh.timeout))
-		defer cancel()
-		sh.reqchan <- runreq{script: script, result: reschan, ctx: ctx}
-		result := <-reschan
+		result, id := sh.resultFor(r, newRequestID(), script, args...)
+		sc := sh.scriptConfig(script)
+		if r.Context().Err() == context.Canceled {
+			// The client has disconnected, so there's no one to respond
+			// to.  Any script run for it has been stopped.
+			debugf("[%s] client disconnected from scrape of script '%s'", id, script)
+			mDisconnects.WithLabelValues(script).Inc()
+			recordOutcome(id, script, result, false)
+			return
+		}
+
+		// Every response says how long the script took, as a sample
+		// Prometheus records with each scrape.  Scripts which may exit
+		// nonzero or fail to match their success regex while still
+		// producing valid output get a script_success metric to tell the
+		// cases apart.
+		extra := []prometheus.Gatherer{constGatherer(prometheus.MustNewConstMetric(
+			durationDesc, prometheus.GaugeValue, result.duration.Seconds()))}
+		if sc.ServeOnExitError || sc.ServeOnTimeout || sc.SuccessRegex != "" {
+			success := 1.0
+			if result.err != nil {
+				success = 0
+			}
+			extra = append(extra, constGatherer(
+				prometheus.MustNewConstMetric(successDesc, prometheus.GaugeValue, success)))
+		}
+
+		if derr, ok := result.err.(disabledError); ok {
+			recordOutcome(id, script, result, false)
+			http.Error(w, derr.Error(), http.StatusForbidden)
+		} else if perr, ok := result.err.(paramError); ok {
+			recordOutcome(id, script, result, false)
+			http.Error(w, fmt.Sprintf("bad request for script '%s' (request id %s): %v", script, id, perr),
+				http.StatusBadRequest)
+		} else if result.err == errNoSuccessMatch && !servableFailure(sc, result) {
+			recordOutcome(id, script, result, false)
+			serveMetrics(w, r, prometheus.Gatherers(extra), promhttp.HandlerOpts{})
+		} else if result.err != nil && !servableFailure(sc, result) {
+			recordOutcome(id, script, result, false)
+			msg := fmt.Sprintf("error running script '%s' (request id %s)", script, id)
+			if sc.VerboseErrors {
+				msg += fmt.Sprintf(": %v", result.err)
+				if result.stderr != "" {
+					msg += "\nstderr:\n" + truncateStderr(result.stderr)
+				}
+			}
+			http.Error(w, msg, http.StatusInternalServerError)
+		} else if gatherer, stats, err := sh.gathererFor(script, result); err != nil {
+			recordOutcome(id, script, result, true)
+			sh.recordParseError(id, script, err)
+			http.Error(w, fmt.Sprintf("error parsing output from script '%s' (request id %s)", script, id),
+				http.StatusInternalServerError)
+		} else {
+			gatherers := append(prometheus.Gatherers{gatherer}, extra...)
+			serveMetrics(w, r, gatherers, promhttp.HandlerOpts{})
+			recordOutcome(id, script, result, false)
+			sh.recordParseStats(id, script, stats)
+		}
+	}
+}
+
+// knownScript returns true if script is named in config, or is a file under
+// scriptPath and maxScripts other such scripts haven't already been run.  With
+// a dispatcher, any script is known subject to maxScripts.  Only known scripts
+// are run, so that only they appear in the script_name label of metrics.
+func (sh *ScriptHandler) knownScript(config *Config, script string) bool {
+	if config != nil {
+		if _, ok := config.Scripts[script]; ok {
+			return true
+		}
+	}
+	if !sh.dispatcher {
+		fi, err := os.Stat(path.Join(sh.scriptPath, script))
+		if err != nil || fi.IsDir() {
+			return false
+		}
+	}
+	if sh.maxScripts <= 0 {
+		return true
+	}
+
+	sh.mtx.RLock()
+	ok := sh.unconfigured[script]
+	sh.mtx.RUnlock()
+	if ok {
+		return true
+	}
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+	if !sh.unconfigured[script] && len(sh.unconfigured) >= sh.maxScripts {
+		warnf("Not running script '%s': -script.max-names %d scripts not in the config have already been run", script, sh.maxScripts)
+		return false
+	}
+	sh.unconfigured[script] = true
+	return true
+}
+
+// Outcomes of a scrape, as counted by script_scrape_outcome_total.
+const (
+	outcomeSuccess             = "success"
+	outcomeError               = "error"
+	outcomeTimeout             = "timeout"
+	outcomeCanceled            = "canceled"
+	outcomeParseError          = "parse_error"
+	outcomeConcurrencyRejected = "concurrency_rejected"
+	outcomeCacheHit            = "cache_hit"
+	outcomeFilterError         = "filter_error"
+	outcomeDisabled            = "disabled"
+)
+
+// recordOutcome counts a scrape of script which got result, and whose output
+// couldn't be parsed if parseFailed is true, and records whether it was served
+// a cached result.  At debug level, the scrape is
+// logged with request id.
+func recordOutcome(id, script string, result runresult, parseFailed bool) {
+	outcome := outcomeSuccess
+	if _, ok := result.err.(concurrencyError); ok {
+		outcome = outcomeConcurrencyRejected
+	} else if _, ok := result.err.(disabledError); ok {
+		outcome = outcomeDisabled
+	} else if _, ok := result.err.(timeoutError); ok {
+		outcome = outcomeTimeout
+	} else if result.err == context.Canceled {
+		outcome = outcomeCanceled
+	} else if _, ok := result.err.(filterError); ok {
+		outcome = outcomeFilterError
+	} else if result.err != nil {
+		outcome = outcomeError
+	} else if parseFailed {
+		outcome = outcomeParseError
+	} else if result.cached {
+		outcome = outcomeCacheHit
+	}
+	mScrapeOutcomes.WithLabelValues(script, outcome).Inc()
+	cached := 0.0
+	if result.cached {
+		cached = 1
+	}
+	mCacheServed.WithLabelValues(script).Set(cached)
+	debugf("[%s] scrape script=%q args=%q duration=%v output_bytes=%d outcome=%s",
+		id, script, result.args, result.duration.Round(time.Millisecond), len(result.output), outcome)
+}
+
+// defaultTimeoutOffset is the default for -timeout-offset.
+const defaultTimeoutOffset = 500 * time.Millisecond
+
+// scrapeTimeout returns how long scripts run on behalf of r may take, given
+// the scrape timeout Prometheus sends in the
+// X-Prometheus-Scrape-Timeout-Seconds header, or 0 if there's no valid header.
+// The timeout is reduced by offset if it's longer than that.
+func scrapeTimeout(r *http.Request, offset time.Duration) time.Duration {
+	v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if v == "" {
+		return 0
+	}
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > offset {
+		timeout -= offset
+	}
+	return timeout
+}
+
+// recordParseStats updates the metrics describing the output of script, run
+// on behalf of request id, and checks it against the script's
+// expected_metrics if any.
+func (sh *ScriptHandler) recordParseStats(id, script string, stats parseStats) {
+	sh.setParseErrorInfo(script, "")
+	mTimeseries.WithLabelValues(script).Set(float64(stats.timeseries))
+	mParseDuration.WithLabelValues(script).Observe(stats.duration.Seconds())
+	if stats.skipped > 0 {
+		warnf("[%s] skipped %d unparseable lines of output from script '%s'", id, stats.skipped, script)
+		mSkippedLines.WithLabelValues(script).Add(float64(stats.skipped))
+	}
+	if !stats.oldest.IsZero() {
+		mDataAge.WithLabelValues(script).Set(time.Since(stats.oldest).Seconds())
+	}
+	if expected := sh.scriptConfig(script).ExpectedMetrics; expected != nil {
+		if unexpected, missing := schemaViolations(expected, stats.names); len(unexpected)+len(missing) > 0 {
+			warnf("[%s] output of script '%s' doesn't match expected_metrics: unexpected %v, missing %v",
+				id, script, unexpected, missing)
+			mSchemaViolations.WithLabelValues(script).Add(1)
+		}
+	}
+}
+
+// maxParseErrorInfo is the length to which errors are truncated in the
+// error label of script_parse_error_info, to bound its cardinality.
+const maxParseErrorInfo = 100
+
+// recordParseError records that the output of script, run on behalf of
+// request id, couldn't be parsed because of err.
+func (sh *ScriptHandler) recordParseError(id, script string, err error) {
+	errorf("[%s] error parsing output from script '%s': %v", id, script, err)
+	mParseErrors.WithLabelValues(script).Add(1)
+	sh.errors.add(script, scriptErrorEntry{Time: time.Now(), RequestID: id, Error: err.Error()})
+
+	msg := err.Error()
+	if len(msg) > maxParseErrorInfo {
+		msg = msg[:maxParseErrorInfo]
+	}
+	sh.setParseErrorInfo(script, msg)
+}
+
+// setParseErrorInfo replaces the script_parse_error_info metric for script
+// with one for msg, or removes it if msg is empty.
+func (sh *ScriptHandler) setParseErrorInfo(script, msg string) {
+	// Most scripts' output parses every time, in which case there's
+	// nothing to do.
+	sh.mtx.RLock()
+	last, ok := sh.parseErrors[script]
+	sh.mtx.RUnlock()
+	if (!ok && msg == "") || (ok && msg == last) {
+		return
+	}
+
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+	if last, ok := sh.parseErrors[script]; ok {
+		mParseErrorInfo.DeleteLabelValues(script, last)
+		delete(sh.parseErrors, script)
+	}
+	if msg != "" {
+		mParseErrorInfo.WithLabelValues(script, msg).Set(1)
+		sh.parseErrors[script] = msg
+	}
+}
+
+// schemaViolations returns those of names which aren't in expected, and those
+// of expected which aren't in names.
+func schemaViolations(expected, names []string) (unexpected, missing []string) {
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		seen[name] = true
+	}
+	want := make(map[string]bool, len(expected))
+	for _, name := range expected {
+		want[name] = true
+		if !seen[name] {
+			missing = append(missing, name)
+		}
+	}
+	for _, name := range names {
+		if !want[name] {
+			unexpected = append(unexpected, name)
+		}
+	}
+	return unexpected, missing
+}
+
+// servableFailure returns true if result is a failure only because the
+// script exited nonzero, timed out or its output didn't match its success
+// regex, and sc says to serve its output regardless.
+func servableFailure(sc ScriptConfig, result runresult) bool {
+	if result.err == errNoSuccessMatch {
+		return !sc.SuccessRegexDropMetrics
+	}
+	if _, ok := result.err.(timeoutError); ok && sc.ServeOnTimeout {
+		return true
+	}
+	return sc.ServeOnExitError && exitCode(result.err) > 0
+}
+
+// newRequestID returns a short random string identifying an HTTP request in
+// log messages and error responses.
+func newRequestID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// resultFor returns the result of running script for r, with request id,
+// and the ID to report it with.  If the script runs on a schedule this is the
+// cached result and ID of its latest run, otherwise the script is run now,
+// with its configured arguments rendered using r's query parameters followed
+// by args, the headers it's configured to be passed, and a description of r
+// in $SCRIPT_REQUEST.
+func (sh *ScriptHandler) resultFor(r *http.Request, id, script string, args ...string) (runresult, string) {
+	if err := sh.checkEnabled(id, script); err != nil {
+		return runresult{err: err}, id
+	}
+	if sc := sh.scriptConfig(script); sc.Interval <= 0 {
+		cargs, err := sc.renderArgs(r.URL.Query())
+		if err != nil {
+			errorf("[%s] error preparing arguments for script '%s': %v", id, script, err)
+			return runresult{err: err}, id
+		}
+		args = append(cargs, args...)
+		deadline := time.Now().Add(sh.timeoutFor(script))
+		if d, ok := r.Context().Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		reqEnv, err := sc.requestEnvVar(r, id, script, args, deadline)
+		if err != nil {
+			errorf("[%s] error preparing environment for script '%s': %v", id, script, err)
+			return runresult{err: err}, id
+		}
+		result := sh.runRepeated(r.Context(), id, script, append(sc.headerEnv(r.Header), reqEnv), args...)
+		result.args = args
+		return result, id
+	}
+	if len(args) > 0 {
+		return runresult{err: fmt.Errorf("scheduled script '%s' can't be given arguments", script)}, id
+	}
+
+	sh.mtx.RLock()
+	cached, ok := sh.cache[script]
+	sh.mtx.RUnlock()
+	if !ok {
+		return runresult{err: fmt.Errorf("scheduled script '%s' hasn't completed a run yet", script)}, id
+	}
+	mCacheServedAge.WithLabelValues(script).Set(time.Since(cached.time).Seconds())
+	result := cached.runresult
+	result.cached = true
+	return result, cached.id
+}
+
+// runScheduled runs script every interval for ever, caching each result for
+// resultFor to return, and pushing it to the Pushgateway if configured.  The
+// first run is delayed by up to the script's configured jitter.
+func (sh *ScriptHandler) runScheduled(script string, interval time.Duration) {
+	if jitter := sh.scriptConfig(script).Jitter; jitter > 0 {
+		time.Sleep(scheduleOffset(interval, jitter))
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		id := newRequestID()
+		var result runresult
+		if args, err := sh.scriptConfig(script).renderArgs(nil); err != nil {
+			errorf("[%s] error preparing arguments for script '%s': %v", id, script, err)
+			result = runresult{err: err}
+		} else {
+			result = sh.runRepeated(context.Background(), id, script, nil, args...)
+		}
+		sh.mtx.Lock()
+		sh.cache[script] = cachedResult{runresult: result, id: id, time: time.Now()}
+		sh.mtx.Unlock()
+		if sc := sh.scriptConfig(script); sc.PushgatewayURL != "" {
+			if err := sh.push(script, sc, result); err != nil {
+				errorf("[%s] error pushing output of script '%s' to %s: %v", id, script, sc.PushgatewayURL, err)
+				mPushErrors.WithLabelValues(script).Add(1)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// scheduleOffset returns a random delay of up to jitter times interval.
+func scheduleOffset(interval time.Duration, jitter float64) time.Duration {
+	return time.Duration(mrand.Float64() * jitter * float64(interval))
+}
+
+// push sends the metrics parsed from result to the Pushgateway configured in
+// sc, replacing those previously pushed for script from this host.  Nothing
+// is pushed for a failed run, so the Pushgateway keeps the last good output.
+func (sh *ScriptHandler) push(script string, sc ScriptConfig, result runresult) error {
+	if result.err != nil && !servableFailure(sc, result) {
+		return nil
+	}
+	gatherer, _, err := sh.gathererFor(script, result)
+	if err != nil {
+		return err
+	}
+	job := sc.PushJob
+	if job == "" {
+		job = strings.Replace(script, "/", "_", -1)
+	}
+	return push.FromGatherer(job, push.HostnameGroupingKey(), sc.PushgatewayURL, gatherer)
+}
+
+// Describe implements prometheus.Collector.
+func (sh *ScriptHandler) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheAgeDesc
+}
+
+// Collect implements prometheus.Collector.  It reports the age of each
+// scheduled script's cached result.
+func (sh *ScriptHandler) Collect(ch chan<- prometheus.Metric) {
+	sh.mtx.RLock()
+	defer sh.mtx.RUnlock()
+	for script, cached := range sh.cache {
+		ch <- prometheus.MustNewConstMetric(cacheAgeDesc, prometheus.GaugeValue,
+			time.Since(cached.time).Seconds(), script)
+	}
+}
+
+// runScript asks Start to run script with args and the extra environment
+// variables env on behalf of request id, subject to the concurrency limit and
+// timeout, and waits for the result.
+func (sh *ScriptHandler) runScript(ctx context.Context, id, script string, env []string, args ...string) runresult {
+	if err := sh.checkEnabled(id, script); err != nil {
+		return runresult{err: err}
+	}
+	mQueueDepth.WithLabelValues(script).Inc()
+	defer mQueueDepth.WithLabelValues(script).Dec()
+
+	reschan := make(chan runresult)
+	timeout := sh.timeoutFor(script)
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	sh.reqchan <- runreq{id: id, script: script, args: args, env: env, timeout: timeout, result: reschan, ctx: ctx}
+	return <-reschan
+}
+
+// runRepeated runs script as runScript does, as many times in succession as
+// its configured repeat.  If there's more than one run, the result is that of
+// the last with the output of all of them in runs.  It stops at the first run
+// that fails, returning its result; output not matching the script's success
+// regex counts as failure.  If the script's circuit breaker is open, it isn't
+// run and the result of its latest failure is returned.
+func (sh *ScriptHandler) runRepeated(ctx context.Context, id, script string, env []string, args ...string) runresult {
+	sc := sh.scriptConfig(script)
+	if result, open := sh.circuitOpen(script, sc); open {
+		debugf("[%s] circuit breaker of script '%s' is open, not running it", id, script)
+		return result
+	}
+	result := sh.runScriptRepeated(ctx, id, script, sc, env, args...)
+	sh.recordCircuit(id, script, sc, result)
+	return result
+}
 
+// runScriptRepeated runs script sc.Repeat times, or once if that's 0,
+// stopping at the first failure.
+func (sh *ScriptHandler) runScriptRepeated(ctx context.Context, id, script string, sc ScriptConfig, env []string, args ...string) runresult {
+	var result runresult
+	var duration time.Duration
+	runs := make([]string, 0, sc.Repeat)
+	for i := 0; i < sc.Repeat || i == 0; i++ {
+		result = sh.runScript(ctx, id, script, env, args...)
+		duration += result.duration
+		result.duration = duration
+		if result.err == nil && !sc.outputMatches(result.output) {
+			warnf("[%s] output of script '%s' doesn't match its success_regex", id, script)
+			result.err = errNoSuccessMatch
+		}
 		if result.err != nil {
-			log.Printf("error running script '%s': %v", script, result.err)
-		} else if err := serveMetricsFromText(sh.opentsdb, w, r, result.output); err != nil {
-			log.Printf("error parsing output from script '%s': %v", script, err)
-			mParseErrors.WithLabelValues(script).Add(1)
+			return result
 		}
+		runs = append(runs, result.output)
+	}
+	if len(runs) > 1 {
+		result.runs = runs
 	}
+	return result
 }
 
-// Start will run forever, handling incoming runreqs.
+// gathererFor interprets the output of script in result as metrics, as
+// gathererFromText does, aggregating the output of repeated runs.
+func (sh *ScriptHandler) gathererFor(script string, result runresult) (prometheus.Gatherer, parseStats, error) {
+	if len(result.runs) > 1 {
+		return gathererFromRuns(sh.parseOpts(script), result.runs, sh.scriptConfig(script).Aggregate)
+	}
+	return gathererFromText(sh.parseOpts(script), result.output)
+}
+
+// serveAll runs each of scripts, which are those listed in the config's
+// all_scripts, in parallel and serves their combined output.  Every metric is given a
+// script_name label identifying the script it came from.  A script_success
+// metric for each script records whether it ran and its output parsed, and a
+// script_duration_seconds metric how long it ran for; a failing script doesn't
+// prevent the others' metrics from being served.
+func (sh *ScriptHandler) serveAll(w http.ResponseWriter, r *http.Request, id string, scripts []string) {
+	gatherers := make([]prometheus.Gatherer, len(scripts))
+	succeeded := make([]bool, len(scripts))
+	durations := make([]time.Duration, len(scripts))
+	var wg sync.WaitGroup
+	for i, script := range scripts {
+		wg.Add(1)
+		go func(i int, script string) {
+			defer wg.Done()
+			result, id := sh.resultFor(r, id, script)
+			durations[i] = result.duration
+			if result.err != nil && !servableFailure(sh.scriptConfig(script), result) {
+				recordOutcome(id, script, result, false)
+				return
+			}
+			gatherer, stats, err := sh.gathererFor(script, result)
+			recordOutcome(id, script, result, err != nil)
+			if err != nil {
+				sh.recordParseError(id, script, err)
+				return
+			}
+			sh.recordParseStats(id, script, stats)
+			gatherers[i] = labelGatherer{gatherer, "script_name", script}
+			succeeded[i] = result.err == nil
+		}(i, script)
+	}
+	wg.Wait()
+
+	var scriptMetrics []prometheus.Metric
+	all := prometheus.Gatherers{}
+	for i, script := range scripts {
+		success := 0.0
+		if succeeded[i] {
+			success = 1
+		}
+		if gatherers[i] != nil {
+			all = append(all, gatherers[i])
+		}
+		scriptMetrics = append(scriptMetrics,
+			prometheus.MustNewConstMetric(successByScriptDesc, prometheus.GaugeValue, success, script),
+			prometheus.MustNewConstMetric(durationByScriptDesc, prometheus.GaugeValue, durations[i].Seconds(), script))
+	}
+	all = append(all, constGatherer(scriptMetrics...))
+
+	serveMetrics(w, r, all, promhttp.HandlerOpts{
+		ErrorLog:      log.New(os.Stderr, "", log.LstdFlags),
+		ErrorHandling: promhttp.ContinueOnError,
+	})
+}
+
+// Start will run forever, handling incoming runreqs.  It also starts running
+// scripts which have an interval configured on their schedules.
 func (sh *ScriptHandler) Start() {
+	sh.recordConfig(sh.getConfig())
+	if config := sh.getConfig(); config != nil {
+		// Disabled scripts get their semaphore when first run, so that
+		// enabling one by reloading the config works.
+		for _, script := range config.AllScripts {
+			if workers := sh.workersFor(script); workers > 0 {
+				sh.slotsFor(script, true, workers)
+			}
+		}
+		for script := range config.Scripts {
+			workers := sh.workersFor(script)
+			if workers > 0 && sh.scriptConfig(script).ConcurrencyKey != concurrencyKeyArgs {
+				sh.slotsFor(script, true, workers)
+			}
+			if interval := sh.scriptConfig(script).Interval; interval > 0 {
+				go sh.runScheduled(script, interval)
+			}
+		}
+	}
+
 	for req := range sh.reqchan {
-		sh.mtx.Lock()
-		curChildCount := sh.numChildren[req.script]
-		sh.mtx.Unlock()
+		req.key, req.byName = sh.concurrencyKey(req)
+		slots := sh.slotsFor(req.key, req.byName, sh.workersFor(req.script))
+		select {
+		case slots <- struct{}{}:
+			go sh.run(req, slots)
+			continue
+		default:
+		}
 
-		if curChildCount >= sh.scriptWorkers {
-			mConcExceeds.WithLabelValues(req.script).Add(1)
-			err := fmt.Errorf("can't spawn a new instance of script '%s': already have %d running", req.script, curChildCount)
-			req.result <- runresult{err: err}
+		if sh.queue {
+			go func(req runreq) {
+				select {
+				case slots <- struct{}{}:
+					sh.run(req, slots)
+				case <-req.ctx.Done():
+					sh.releaseSlots(req)
+					mConcExceeds.WithLabelValues(req.script).Add(1)
+					err := concurrencyError{fmt.Sprintf("gave up waiting to spawn a new instance of script '%s': %v", req.script, req.ctx.Err())}
+					warnf("[%s] %v", req.id, err)
+					req.result <- runresult{err: err}
+				}
+			}(req)
 			continue
 		}
 
-		sh.mtx.Lock()
-		sh.numChildren[req.script]++
-		sh.mtx.Unlock()
+		sh.releaseSlots(req)
+		mConcExceeds.WithLabelValues(req.script).Add(1)
+		err := concurrencyError{fmt.Sprintf("can't spawn a new instance of script '%s': already have %d running", req.script, len(slots))}
+		warnf("[%s] %v", req.id, err)
+		req.result <- runresult{err: err}
+	}
+}
 
-		mRunning.WithLabelValues(req.script).Add(1)
+// concurrencyKey returns the key of the semaphore limiting concurrent
+// invocations of the script requested by req, and whether that's simply the
+// script name.
+func (sh *ScriptHandler) concurrencyKey(req runreq) (string, bool) {
+	if sh.scriptConfig(req.script).ConcurrencyKey != concurrencyKeyArgs {
+		return req.script, true
+	}
+	return req.script + "\x00" + strings.Join(req.args, "\x00"), false
+}
 
-		go func(req runreq) {
-			mRuns.WithLabelValues(req.script).Add(1)
-			start := time.Now()
-			ctx, cancel := context.WithCancel(req.ctx)
-			defer cancel()
+// timeoutFor returns the soft timeout of script, before any scrape timeout
+// is taken into account.
+func (sh *ScriptHandler) timeoutFor(script string) time.Duration {
+	if timeout := sh.scriptConfig(script).Timeout; timeout > 0 {
+		return timeout
+	}
+	return sh.timeout
+}
 
-			output, err := runCommand(ctx, path.Join(sh.scriptPath, req.script))
-			elapsed := time.Since(start)
-			mDuration.WithLabelValues(req.script).Add(float64(elapsed) / float64(time.Second))
+// workersFor returns the limit on concurrent invocations of script, 0 if it's
+// disabled.
+func (sh *ScriptHandler) workersFor(script string) int {
+	if workers := sh.scriptConfig(script).Workers; workers != nil {
+		return *workers
+	}
+	return sh.scriptWorkers
+}
 
-			if err != nil {
-				mErrors.WithLabelValues(req.script).Add(1)
+// slotsFor returns the channel of the semaphore with key, creating it with
+// room for workers if need be.  Semaphores keyed by script name are kept for
+// ever, others must be given back using releaseSlots once the request is done
+// with them.
+func (sh *ScriptHandler) slotsFor(key string, byName bool, workers int) chan struct{} {
+	if byName {
+		sh.mtx.RLock()
+		sem, ok := sh.slots[key]
+		sh.mtx.RUnlock()
+		if ok {
+			return sem.slots
+		}
+	}
+
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+	sem, ok := sh.slots[key]
+	if !ok {
+		sem = &semaphore{slots: make(chan struct{}, workers)}
+		sh.slots[key] = sem
+		if byName {
+			mConcAvailable.WithLabelValues(key).Set(float64(workers))
+		}
+	}
+	if !byName {
+		sem.refs++
+	}
+	return sem.slots
+}
+
+// releaseSlots gives back the semaphore obtained by slotsFor for req,
+// discarding it if it's keyed by arguments and no longer in use.
+func (sh *ScriptHandler) releaseSlots(req runreq) {
+	if req.byName {
+		return
+	}
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+	sem := sh.slots[req.key]
+	sem.refs--
+	if sem.refs == 0 {
+		delete(sh.slots, req.key)
+	}
+}
+
+// run runs the script requested by req and sends the result back, releasing
+// the slot it holds in slots once the script has exited.
+func (sh *ScriptHandler) run(req runreq, slots chan struct{}) {
+	if req.byName {
+		mConcAvailable.WithLabelValues(req.script).Dec()
+	}
+	mRunning.WithLabelValues(req.script).Add(1)
+	mRuns.WithLabelValues(req.script).Add(1)
+	start := time.Now()
+	ctx, cancel := context.WithCancel(req.ctx)
+	defer cancel()
+
+	scriptFile, args := path.Join(sh.scriptPath, req.script), req.args
+	var argsErr error
+	if sh.dispatcher {
+		scriptFile, args = sh.scriptPath, append([]string{req.script}, req.args...)
+	} else {
+		var fileArgs []string
+		fileArgs, argsErr = sh.fileArgs(scriptFile + argsFileSuffix)
+		args = append(append([]string{}, fileArgs...), args...)
+	}
+	sc := sh.scriptConfig(req.script)
+	opts := commandOpts{
+		dir:             sc.Workdir,
+		user:            sc.User,
+		group:           sc.Group,
+		killGracePeriod: sc.KillGracePeriod,
+		hardTimeout:     sc.HardTimeout,
+		successCodes:    sc.SuccessExitCodes,
+		allowStderr:     !sc.stderrIsError(),
+		nice:            sc.Nice,
+		ioClass:         sc.IOClass,
+		ioPriority:      sc.IOPriority,
+		limits:          rlimits{memory: sc.MemoryLimit, files: sc.FileLimit, cpu: sc.CPULimit},
+		env:             req.env,
+	}
+	if opts.dir == "" && sc.WorkdirFromScript {
+		opts.dir = path.Dir(scriptFile)
+	}
+	if opts.allowStderr && sc.StderrLog != stderrLogSummary {
+		opts.stderrLine = func(line string) {
+			infof("[%s] %s: %s", req.id, req.script, line)
+		}
+	}
+
+	var stderr bytes.Buffer
+	opts.stderr = &stderr
+
+	output, err := "", argsErr
+	if err == nil {
+		output, err = sh.runner(ctx, opts, scriptFile, args...)
+	}
+	if sc.OutputFile != "" {
+		filename := sc.OutputFile
+		if !path.IsAbs(filename) && opts.dir != "" {
+			filename = path.Join(opts.dir, filename)
+		}
+		if err == nil {
+			output, err = readOutputFile(filename, start)
+		}
+		if sc.RemoveOutputFile {
+			if rerr := os.Remove(filename); rerr != nil && !os.IsNotExist(rerr) {
+				errorf("[%s] error removing output file of script '%s': %v", req.id, req.script, rerr)
 			}
-			if err == context.DeadlineExceeded {
-				mTimeouts.WithLabelValues(req.script).Add(1)
+		}
+	}
+	// Filter the output unless the script didn't get as far as writing
+	// it.  If the script failed as well, its error takes precedence.
+	if len(sc.FilterCommand) > 0 && exitCode(err) >= 0 {
+		var ferr error
+		output, ferr = runFilter(ctx, sc.FilterCommand, opts, output)
+		if ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	elapsed := time.Since(start)
+	mDuration.WithLabelValues(req.script).Add(float64(elapsed) / float64(time.Second))
+
+	if err == context.Canceled {
+		// The scrape was given up on, most likely by the client
+		// disconnecting, which says nothing about the script.
+		infof("[%s] script '%s' canceled after %v", req.id, req.script, elapsed)
+		mCanceled.WithLabelValues(req.script).Add(1)
+	} else if err != nil {
+		errorf("[%s] error running script '%s' after %v: %v", req.id, req.script, elapsed, err)
+		mErrors.WithLabelValues(req.script).Add(1)
+		sh.errors.add(req.script, scriptErrorEntry{
+			Time:      time.Now(),
+			RequestID: req.id,
+			Error:     err.Error(),
+			ExitCode:  exitCode(err),
+			Stderr:    stderr.String(),
+		})
+	}
+	if _, ok := err.(timeoutError); ok {
+		warnf("[%s] script '%s' timed out, timeout is %v", req.id, req.script, req.timeout.Round(time.Millisecond))
+		mTimeouts.WithLabelValues(req.script).Add(1)
+	}
+	if _, ok := err.(spawnError); ok {
+		mSpawnErrors.WithLabelValues(req.script).Add(1)
+	}
+	if _, ok := err.(filterError); ok {
+		mFilterErrors.WithLabelValues(req.script).Add(1)
+	}
+	if err == nil && emptyOutput(output) {
+		mEmptyOutput.WithLabelValues(req.script).Add(1)
+	}
+	if opts.allowStderr && opts.stderrLine == nil && stderr.Len() != 0 {
+		infof("[%s] script '%s' wrote to stderr:\n%s", req.id, req.script, truncateStderr(stderr.String()))
+	}
+
+	release := func() {
+		<-slots
+		sh.releaseSlots(req)
+		if req.byName {
+			mConcAvailable.WithLabelValues(req.script).Inc()
+		}
+		mRunning.WithLabelValues(req.script).Add(-1)
+	}
+	if _, ok := err.(timeoutError); ok && len(sc.TimeoutCommand) > 0 {
+		// Keep the slot until the cleanup is done, so that the next run
+		// doesn't overlap it, but don't keep the requester waiting.
+		go func() {
+			sh.runTimeoutCommand(req, sc.TimeoutCommand, opts, scriptFile)
+			release()
+		}()
+	} else {
+		// Release the slot before replying, so that a request made as
+		// soon as this one completes doesn't find the script still
+		// running.
+		release()
+	}
+
+	req.result <- runresult{output: output, stderr: stderr.String(), err: err, duration: elapsed}
+}
+
+// timeoutCommandTimeout limits how long a script's timeout_command may run.
+const timeoutCommandTimeout = 10 * time.Second
+
+// runTimeoutCommand runs command, the timeout_command configured for the
+// script requested by req, after it has timed out.  It's run with the same
+// working directory and credentials as the script, and is given the script's
+// path as its last argument.  Its output and any error are logged.
+func (sh *ScriptHandler) runTimeoutCommand(req runreq, command []string, opts commandOpts, scriptFile string) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutCommandTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	opts.stderr, opts.stderrLine, opts.allowStderr = &stderr, nil, true
+	args := append(append([]string{}, command[1:]...), scriptFile)
+	output, err := runCommand(ctx, opts, command[0], args...)
+	if err != nil {
+		errorf("[%s] error running timeout command for script '%s': %v", req.id, req.script, err)
+	}
+	if out := strings.TrimSpace(output + stderr.String()); out != "" {
+		infof("[%s] timeout command for script '%s' wrote:\n%s", req.id, req.script, truncateStderr(out))
+	}
+}
+
+// runFilter runs command, the filter_command configured for a script, with
+// output as its stdin, returning what it writes to stdout.  It's run with the
+// same options as the script, so that what it writes to stderr is treated the
+// same way.  Any error is a filterError.
+func runFilter(ctx context.Context, command []string, opts commandOpts, output string) (string, error) {
+	opts.stdin = strings.NewReader(output)
+	filtered, err := runCommand(ctx, opts, command[0], command[1:]...)
+	if err != nil {
+		return filtered, filterError{err}
+	}
+	return filtered, nil
+}
+
+// selftestHandler returns a handler which serves the output of a built-in
+// script, in the format given by parse, without running anything.  It lets
+// the HTTP and parsing pipeline be tested in isolation.
+func selftestHandler(parse parseOpts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now().Unix()
+		text := fmt.Sprintf("script_exporter_selftest_up 1\nscript_exporter_selftest_time_seconds %d\n", now)
+		if parse.opentsdb {
+			text = fmt.Sprintf("script_exporter.selftest.up %d 1\nscript_exporter.selftest.time_seconds %d %d\n", now, now, now)
+		}
+		if _, err := serveMetricsFromText(parse, w, r, text); err != nil {
+			errorf("error parsing selftest output: %v", err)
+			http.Error(w, fmt.Sprintf("error parsing selftest output: %v", err), http.StatusInternalServerError)
+		}
+	})
+}
+
+// headerFlags is a repeatable flag collecting HTTP headers given as
+// "Name: value".
+type headerFlags http.Header
+
+// String implements flag.Value.
+func (hf headerFlags) String() string {
+	var headers []string
+	for name, values := range hf {
+		for _, value := range values {
+			headers = append(headers, name+": "+value)
+		}
+	}
+	return strings.Join(headers, ", ")
+}
+
+// Set implements flag.Value.
+func (hf headerFlags) Set(s string) error {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return fmt.Errorf("header '%s' isn't of the form 'Name: value'", s)
+	}
+	http.Header(hf).Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	return nil
+}
+
+// addressFlags is a repeatable flag collecting addresses to listen on.  The
+// first address given replaces the defaults; an empty address adds nothing.
+type addressFlags struct {
+	addrs []string
+	set   bool
+}
+
+// String implements flag.Value.
+func (af *addressFlags) String() string {
+	if af == nil {
+		return ""
+	}
+	return strings.Join(af.addrs, ", ")
+}
+
+// Set implements flag.Value.
+func (af *addressFlags) Set(s string) error {
+	if !af.set {
+		af.addrs, af.set = nil, true
+	}
+	if s != "" {
+		af.addrs = append(af.addrs, s)
+	}
+	return nil
+}
+
+// withHeaders returns a handler which adds headers to every response before
+// passing the request on to h.  Since h sets Content-Type itself, any
+// Content-Type in headers is overridden.
+func withHeaders(h http.Handler, headers http.Header) http.Handler {
+	if len(headers) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range headers {
+			for _, value := range values {
+				w.Header().Add(name, value)
 			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
 
-			sh.mtx.Lock()
-			sh.numChildren[req.script]--
-			sh.mtx.Unlock()
-			mRunning.WithLabelValues(req.script).Add(-1)
+// pprofHandler returns a handler serving the net/http/pprof endpoints under
+// /debug/pprof/.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
 
-			req.result <- runresult{output: output, err: err}
-		}(req)
+// limitRequests returns a handler which passes requests on to h, unless max
+// requests are already being handled, in which case it responds 503.  If max
+// is 0 there's no limit.
+func limitRequests(h http.Handler, max int) http.Handler {
+	if max <= 0 {
+		return h
 	}
+	sem := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			h.ServeHTTP(w, r)
+		default:
+			mRequestsRejected.Inc()
+			http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// writeTimeoutMargin is how much longer than the script timeout the server's
+// write timeout must be, to leave time to serve the script's output.
+const writeTimeoutMargin = 5 * time.Second
+
+// runTime returns the longest a request for a script with settings sc can
+// spend running it, timeout being the default timeout: every run may take
+// its timeout and kill grace period, or its hard timeout if it has one, and
+// the time allowed to drain its stdout.
+func runTime(timeout time.Duration, sc ScriptConfig) time.Duration {
+	if sc.Timeout > 0 {
+		timeout = sc.Timeout
+	}
+	run := timeout + sc.KillGracePeriod
+	if sc.HardTimeout > 0 {
+		run = timeout
+		if sc.HardTimeout > run {
+			run = sc.HardTimeout
+		}
+	}
+	run += stdoutDrainTimeout
+	if sc.Repeat > 1 {
+		run *= time.Duration(sc.Repeat)
+	}
+	return run
+}
+
+// longestRunTime returns the longest runTime of any script, whether named in
+// config, which may be nil, or using the defaults.
+func (sh *ScriptHandler) longestRunTime(config *Config) time.Duration {
+	longest := runTime(sh.timeout, sh.defaults)
+	if config != nil {
+		for _, sc := range config.Scripts {
+			if run := runTime(sh.timeout, sc.merge(sh.defaults)); run > longest {
+				longest = run
+			}
+		}
+	}
+	return longest
+}
+
+// serverWriteTimeout returns the write timeout to give the HTTP server.  The
+// write timeout covers the whole time spent handling a request, including
+// running the script, so it's raised to scriptTime, the longest that can
+// take, plus a margin if it's less than that.  If requested is 0 that's what
+// is used.
+func serverWriteTimeout(requested, scriptTime time.Duration) time.Duration {
+	if min := scriptTime + writeTimeoutMargin; requested < min {
+		if requested != 0 {
+			warnf("Raising -web.write-timeout from %v to %v so scripts have time to complete", requested, min)
+		}
+		return min
+	}
+	return requested
 }
 
 func main() {
+	headers := headerFlags{}
+	flag.Var(headers, "web.header",
+		"header to add to metrics responses, as 'Name: value'; may be repeated")
+	listenAddresses := &addressFlags{addrs: []string{":9661"}}
+	flag.Var(listenAddresses, "web.listen-address",
+		"Address on which to expose metrics and web interface; may be repeated.  Set to empty to listen only on -web.listen-socket.")
 	var (
-		listenAddress = flag.String("web.listen-address", ":9661",
-			"Address on which to expose metrics and web interface.")
+		adminAddress = flag.String("web.admin-address", "",
+			"Address on which to expose the exporter's own metrics, readiness and debugging endpoints, instead of -web.listen-address.")
+		listenSocket = flag.String("web.listen-socket", "",
+			"Path of a Unix domain socket on which to expose metrics and web interface, in addition to -web.listen-address.")
+		tlsCert = flag.String("web.tls-cert-file", "",
+			"certificate to serve HTTPS on -web.listen-address with; requires -web.tls-key-file")
+		tlsKey = flag.String("web.tls-key-file", "",
+			"private key of -web.tls-cert-file")
+		tlsClientCA = flag.String("web.tls-client-ca-file", "",
+			"CA bundle clients must present a certificate signed by; requires -web.tls-cert-file")
+		readTimeout = flag.Duration("web.read-timeout", 5*time.Second,
+			"maximum duration for reading an entire request")
+		writeTimeout = flag.Duration("web.write-timeout", 0,
+			"maximum duration for handling a request and writing the response; at least -timeout plus 5s, which is the default")
+		adminWriteTimeout = flag.Duration("web.admin-write-timeout", time.Minute,
+			"maximum duration for handling a request on -web.admin-address and writing the response; must exceed the duration of any profile fetched from /debug/pprof/")
+		idleTimeout = flag.Duration("web.idle-timeout", 0,
+			"maximum time to wait for the next request on a keep-alive connection; if 0, -web.read-timeout is used")
+		maxRequests = flag.Int("web.max-requests", 0,
+			"maximum number of HTTP requests handled at once across all scripts, beyond which requests get a 503 response; 0 means no limit")
 		metricsPath = flag.String("web.telemetry-path", "/metrics",
 			"Path under which to expose metrics.")
+		scriptArchive = flag.String("script.archive", "",
+			"tar, gzipped tar or zip file to extract scripts from at startup, instead of -script.path")
+		dispatcher = flag.Bool("script.dispatcher", false,
+			"treat -script.path as a single executable which runs every script, passing it the script name as its first argument")
 		scriptPath = flag.String("script.path", "",
 			"path under which scripts are located")
 		opentsdb = flag.Bool("opentsdb", false,
 			"expect opentsdb-format metrics from script output")
+		stripCRFlag = flag.Bool("script.strip-cr", true,
+			"convert CRLF line endings in script output to LF before parsing it")
+		labelValueSanitize = flag.String("opentsdb.label-value-sanitize", string(sanitizeEscape),
+			"what to do with opentsdb tag values containing control characters or invalid UTF-8: escape, strip, or reject")
 		timeout = flag.Duration("timeout", time.Minute,
 			"how long a script can run before being cancelled")
+		timeoutOffset = flag.Duration("timeout-offset", defaultTimeoutOffset,
+			"how much sooner than the scrape timeout Prometheus sends to time out scripts run for the scrape")
+		killGracePeriod = flag.Duration("timeout.kill-grace-period", 0,
+			"how long a timed out script has to exit after SIGTERM before being sent SIGKILL; if 0, SIGKILL is sent immediately")
 		scworkers = flag.Int("script-workers", 1,
 			"allow this many concurrent requests per script")
+		workdir = flag.String("script.workdir", "",
+			"working directory for scripts; if empty, the exporter's working directory is used")
+		workdirFromScript = flag.Bool("script.workdir-from-script", false,
+			"run each script in the directory containing it, unless a workdir is configured")
+		scriptUser = flag.String("script.user", "",
+			"user name or uid to run scripts as; requires root")
+		scriptGroup = flag.String("script.group", "",
+			"group name or gid to run scripts as; defaults to the primary group of -script.user")
+		emptyOutputIsError = flag.Bool("script.empty-output-is-error", false,
+			"treat a script which exits successfully without writing any metrics as having failed to parse")
+		verboseErrors = flag.Bool("web.verbose-errors", false,
+			"include the error and the script's stderr in failed scrape responses; may leak sensitive information")
+		configFile = flag.String("config.file", "",
+			"path to YAML, JSON, or TOML file containing per-script settings")
+		configURL = flag.String("config.url", "",
+			"URL to fetch per-script settings from instead of -config.file")
+		configURLPoll = flag.Duration("config.url-poll-interval", 0,
+			"how often to check -config.url for changes; if 0, it's only fetched at startup")
+		concurrencyKey = flag.String("script-workers.key", concurrencyKeyName,
+			"limit concurrent requests per script name (name) or per script name and arguments (args)")
+		maxScripts = flag.Int("script.max-names", 0,
+			"if positive, the most scripts not named in the config which may be run; requests for others get a 404, bounding metric cardinality")
+		queue = flag.Bool("script-workers.queue", false,
+			"when a script already has -script-workers instances running, wait until the request times out for one to finish rather than failing immediately")
+		stderrIsError = flag.Bool("script.stderr-is-error", true,
+			"treat a script writing to stderr as having failed; if false, what it writes is logged instead")
+		stderrLog = flag.String("script.stderr-log", stderrLogLines,
+			"when stderr isn't an error, log each line as it's written (lines) or all of it once the script exits (summary)")
+		selftest = flag.Bool("selftest", false,
+			"serve the output of a built-in script at <web.telemetry-path>/selftest, to check the exporter works")
+		debugRunAuth = flag.String("debug.run-auth-file", "",
+			"enable /debug/run/<script>, which serves a script's raw output, for clients authenticating with the user:password in this file")
+		pprofEnabled = flag.Bool("debug.pprof", false,
+			"enable the Go profiling endpoints under /debug/pprof/; requires -web.admin-address or -debug.pprof-auth-file")
+		pprofAuth = flag.String("debug.pprof-auth-file", "",
+			"only serve /debug/pprof/ to clients authenticating with the user:password in this file")
+		scriptErrorsAuth = flag.String("debug.script-errors-auth-file", "",
+			"serve /debug/script-errors to clients authenticating with the user:password in this file; without it, it's only served on -web.admin-address")
+		namespace = flag.String("metrics.namespace", defaultNamespace,
+			"prefix of the names of the exporter's own metrics")
+		textfileDir = flag.String("textfile.directory", "",
+			"directory to serve the metrics in *.prom files from, like node_exporter's textfile collector")
+		textfilePath = flag.String("textfile.path", "/textfile",
+			"path under which to serve the metrics in -textfile.directory")
+		argsFromPath = flag.Bool("script.args-from-path", false,
+			"treat only the first segment of the path after -web.telemetry-path as the script name, passing the rest to it as arguments")
+		hostnameLabel = flag.String("script.hostname-label", "",
+			"if set, add a label of this name with the host's hostname to the metrics of every script")
+		logLevelFlag = flag.String("log.level", "info",
+			"only log messages at this level or above: debug, info, warn or error; debug logs every scrape")
+		waitForPath = flag.Bool("script.wait-for-path", false,
+			"don't report ready or serve scripts until -script.path contains at least one executable")
+		watchInterval = flag.Duration("script.watch-interval", 0,
+			"if nonzero, check -script.path for scripts being added, removed or modified this often, reporting them in script_files and script_files_changed_total")
+		watchInvalidate = flag.Bool("script.watch-invalidate", false,
+			"when -script.watch-interval finds a script has changed, forget its failures so that a circuit breaker doesn't stop it being run")
 	)
 	flag.Parse()
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	level, err := parseLogLevel(*logLevelFlag)
+	if err != nil {
+		log.Fatalf("Invalid -log.level: %v", err)
+	}
+	setLogLevel(level)
+
+	if !model.IsValidMetricName(model.LabelValue(*namespace)) {
+		log.Fatalf("Invalid -metrics.namespace '%s'", *namespace)
+	}
+	newMetrics(*namespace)
+	registerMetrics()
+
+	labelValues, err := parseLabelValueSanitizer(*labelValueSanitize)
+	if err != nil {
+		log.Fatalf("Invalid -opentsdb.label-value-sanitize: %v", err)
+	}
+	parse := parseOpts{opentsdb: *opentsdb, labelValues: labelValues, stripCR: *stripCRFlag}
+	if *hostnameLabel != "" {
+		if !model.LabelName(*hostnameLabel).IsValid() || strings.HasPrefix(*hostnameLabel, "__") {
+			log.Fatalf("Invalid -script.hostname-label '%s'", *hostnameLabel)
+		}
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("Unable to get hostname for -script.hostname-label: %v", err)
+		}
+		parse.labels = map[string]string{*hostnameLabel: hostname}
+	}
+
+	var config *Config
+	if *configFile != "" {
+		config, err = LoadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("Error loading config: %v", err)
+		}
+	}
+	defaults := ScriptConfig{
+		Workdir:            *workdir,
+		WorkdirFromScript:  *workdirFromScript,
+		User:               *scriptUser,
+		Group:              *scriptGroup,
+		KillGracePeriod:    *killGracePeriod,
+		VerboseErrors:      *verboseErrors,
+		EmptyOutputIsError: *emptyOutputIsError,
+		StderrIsError:      stderrIsError,
+		StderrLog:          *stderrLog,
+		ConcurrencyKey:     *concurrencyKey,
+	}
+	if err := checkStderrLog(defaults.StderrLog); err != nil {
+		log.Fatalf("Invalid -script.stderr-log: %v", err)
+	}
+	if err := checkConcurrencyKey(defaults.ConcurrencyKey); err != nil {
+		log.Fatalf("Invalid -script-workers.key: %v", err)
+	}
+	if err := checkCredential(defaults.User, defaults.Group); err != nil {
+		log.Fatalf("Invalid -script.user or -script.group: %v", err)
+	}
+	if *configURL != "" {
+		if *configFile != "" {
+			log.Fatalf("Only one of -config.file and -config.url may be given")
+		}
+		config, err = loadConfigURLWithRetry(*configURL, 5, time.Second)
+		if err != nil {
+			log.Fatalf("Error loading config: %v", err)
+		}
+	}
+	if err := checkConfigCredentials(config, defaults); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if err := checkConfigTimeouts(config, *timeout); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	// cleanup removes the scripts extracted from -script.archive, if any.
+	// Exits from here on must go through fatalf so that it's called.
+	cleanup := func() {}
+	fatalf := func(format string, args ...interface{}) {
+		cleanup()
+		log.Fatalf(format, args...)
+	}
+	if *scriptArchive != "" {
+		if *scriptPath != "" {
+			log.Fatalf("Only one of -script.path and -script.archive may be given")
+		}
+		dir, err := extractArchive(*scriptArchive)
+		if err != nil {
+			log.Fatalf("Error extracting -script.archive: %v", err)
+		}
+		infof("Extracted scripts from %s to %s", *scriptArchive, dir)
+		cleanup = func() { os.RemoveAll(dir) }
+		defer cleanup()
+		*scriptPath = dir
+	}
+	if *dispatcher {
+		if *scriptArchive != "" || *waitForPath {
+			fatalf("-script.dispatcher can't be combined with -script.archive or -script.wait-for-path")
+		}
+		if fi, err := os.Stat(*scriptPath); err != nil || fi.IsDir() {
+			fatalf("-script.dispatcher requires -script.path to name an executable file")
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 			<head><title>Script Exporter</title></head>
 			<body>
@@ -217,13 +1891,196 @@ func main() {
 			</html>`))
 	})
 
-	sh := NewScriptHandler(*metricsPath, *scriptPath, *opentsdb, *scworkers, *timeout)
+	// The exporter's own metrics, health and debugging endpoints go on the
+	// admin mux, which is the main one unless an admin address is given.
+	adminMux := mux
+	if *adminAddress != "" {
+		adminMux = http.NewServeMux()
+	}
+	if *pprofEnabled {
+		h := pprofHandler()
+		if *pprofAuth != "" {
+			user, password, err := readAuthFile(*pprofAuth)
+			if err != nil {
+				fatalf("Invalid -debug.pprof-auth-file: %v", err)
+			}
+			h = basicAuth(h, user, password)
+		} else if *adminAddress == "" {
+			fatalf("-debug.pprof requires -web.admin-address or -debug.pprof-auth-file")
+		}
+		adminMux.Handle("/debug/pprof/", h)
+	}
+
+	rd := &readiness{}
+	if *waitForPath {
+		go waitForScripts(rd, *scriptPath, time.Second, 30*time.Second)
+	} else {
+		rd.setReady()
+	}
+	adminMux.Handle("/-/ready", rd)
+
+	sh := NewScriptHandler(*metricsPath, *scriptPath, parse, *scworkers, *timeout, defaults, config)
+	if *watchInterval > 0 {
+		sw := &scriptWatcher{dir: *scriptPath}
+		if *watchInvalidate {
+			sw.onChange = sh.forgetFailures
+		}
+		go sw.run(*watchInterval)
+	} else if *watchInvalidate {
+		fatalf("-script.watch-invalidate requires -script.watch-interval")
+	}
+	sh.pathArgs = *argsFromPath
+	sh.queue = *queue
+	sh.maxScripts = *maxScripts
+	sh.writeTimeout = serverWriteTimeout(*writeTimeout, sh.longestRunTime(config))
+	sh.dispatcher = *dispatcher
+	sh.timeoutOffset = *timeoutOffset
 	go sh.Start()
-	http.Handle(*metricsPath+"/", sh)
-	http.Handle(*metricsPath, promhttp.Handler())
+	if *configURL != "" && *configURLPoll > 0 {
+		go pollConfigURL(*configURL, *configURLPoll, nil, func(config *Config) {
+			if err := checkConfigCredentials(config, defaults); err != nil {
+				errorf("Not applying config from %s: %v", *configURL, err)
+				return
+			}
+			if err := checkConfigTimeouts(config, *timeout); err != nil {
+				errorf("Not applying config from %s: %v", *configURL, err)
+				return
+			}
+			infof("Applying updated config from %s", *configURL)
+			sh.setConfig(config)
+		})
+	}
+	prometheus.MustRegister(sh)
+	mux.Handle(*metricsPath+"/", withHeaders(rd.gate(sh), http.Header(headers)))
+	if *adminAddress != "" {
+		sh.hideSelfMetrics = true
+		adminMux.Handle(*metricsPath, promhttp.Handler())
+		mux.Handle(*metricsPath, http.NotFoundHandler())
+	} else {
+		mux.Handle(*metricsPath, withHeaders(promhttp.Handler(), http.Header(headers)))
+	}
+	// Scripts' recent errors include their stderr, so they're only served
+	// on the admin address or to authenticated clients.
+	if *scriptErrorsAuth != "" {
+		user, password, err := readAuthFile(*scriptErrorsAuth)
+		if err != nil {
+			fatalf("Invalid -debug.script-errors-auth-file: %v", err)
+		}
+		adminMux.Handle("/debug/script-errors", basicAuth(sh.errors, user, password))
+	} else if *adminAddress != "" {
+		adminMux.Handle("/debug/script-errors", sh.errors)
+	}
+	if *selftest {
+		mux.Handle(*metricsPath+"/selftest", withHeaders(selftestHandler(parse), http.Header(headers)))
+	}
+	if *debugRunAuth != "" {
+		user, password, err := readAuthFile(*debugRunAuth)
+		if err != nil {
+			fatalf("Invalid -debug.run-auth-file: %v", err)
+		}
+		mux.Handle("/debug/run/", basicAuth(sh.debugRunHandler("/debug/run/"), user, password))
+	}
+	if *textfileDir != "" {
+		mux.Handle(*textfilePath, withHeaders(textfileHandler(*textfileDir), http.Header(headers)))
+	}
 
-	srv := &http.Server{Addr: *listenAddress, ReadTimeout: 5 * time.Second, WriteTimeout: 5 * time.Second}
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatalf("Unable to setup HTTP server: %v", err)
+	var tlsConfig *tls.Config
+	if *tlsCert != "" || *tlsKey != "" || *tlsClientCA != "" {
+		tlsConfig, err = serverTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			fatalf("Invalid TLS settings: %v", err)
+		}
+	}
+
+	var listeners []net.Listener
+	for _, addr := range listenAddresses.addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			fatalf("Unable to listen on %s: %v", addr, err)
+		}
+		if tlsConfig != nil {
+			l = tls.NewListener(l, tlsConfig)
+		}
+		listeners = append(listeners, l)
+	}
+	if *listenSocket != "" {
+		l, err := listenUnix(*listenSocket)
+		if err != nil {
+			fatalf("Unable to listen on %s: %v", *listenSocket, err)
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		fatalf("One of -web.listen-address or -web.listen-socket is required")
+	}
+
+	var handler http.Handler = mux
+	if *tlsClientCA != "" {
+		handler = logClientCN(handler)
+	}
+	srv := &http.Server{
+		Handler:      limitRequests(handler, *maxRequests),
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: sh.writeTimeout,
+		IdleTimeout:  *idleTimeout,
+	}
+	servers := []*http.Server{srv}
+	errs := make(chan error, len(listeners)+1)
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- srv.Serve(l)
+		}(l)
+	}
+	if *adminAddress != "" {
+		l, err := net.Listen("tcp", *adminAddress)
+		if err != nil {
+			fatalf("Unable to listen on %s: %v", *adminAddress, err)
+		}
+		adminSrv := &http.Server{
+			Handler:      adminMux,
+			ReadTimeout:  *readTimeout,
+			WriteTimeout: *adminWriteTimeout,
+			IdleTimeout:  *idleTimeout,
+		}
+		servers = append(servers, adminSrv)
+		go func() {
+			errs <- adminSrv.Serve(l)
+		}()
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		// Close the listeners so that the socket file, if any, is removed.
+		for _, srv := range servers {
+			srv.Close()
+		}
+		fatalf("Unable to setup HTTP server: %v", err)
+	case sig := <-sigs:
+		infof("Received %v, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			errorf("Error shutting down HTTP server: %v", err)
+		}
+	}
+}
+
+// listenUnix listens on a Unix domain socket at path.  A socket file left
+// behind at path by a previous run is removed first.  The socket file is
+// removed again when the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
 	}
+	return net.Listen("unix", path)
 }
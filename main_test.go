@@ -0,0 +1,1298 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	. "gopkg.in/check.v1"
+)
+
+// writeScripts creates a temporary directory containing executable scripts
+// with the given names and contents, returning the directory's path.
+func writeScripts(c *C, scripts map[string]string) string {
+	dir, err := ioutil.TempDir("", "script-exporter")
+	c.Assert(err, IsNil)
+	for name, content := range scripts {
+		c.Assert(ioutil.WriteFile(path.Join(dir, name), []byte(content), 0755), IsNil)
+	}
+	return dir
+}
+
+func (s MySuite) TestServeAll(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"good":  "#!/bin/sh\necho 'foo{a=\"b\"} 1'\n",
+		"good2": "#!/bin/sh\necho 'foo{a=\"b\"} 2'\n",
+		"bad":   "#!/bin/sh\nexit 1\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{},
+		&Config{AllScripts: []string{"good", "good2", "bad"}})
+	go sh.Start()
+
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/all", nil))
+	c.Assert(w.Code, Equals, 200)
+	body := w.Body.String()
+	c.Check(body, Matches, `(?s).*foo{a="b",script_name="good"} 1\n.*`)
+	c.Check(body, Matches, `(?s).*foo{a="b",script_name="good2"} 2\n.*`)
+	c.Check(body, Matches, `(?s).*script_success{script_name="bad"} 0\n.*`)
+	c.Check(body, Matches, `(?s).*script_success{script_name="good"} 1\n.*`)
+	c.Check(body, Matches, `(?s).*script_success{script_name="good2"} 1\n.*`)
+	c.Check(body, Matches, `(?s).*script_duration_seconds{script_name="good"} [0-9.e-]+\n.*`)
+
+	var m dto.Metric
+	mParseDuration.WithLabelValues("good").(prometheus.Metric).Write(&m)
+	c.Check(m.GetHistogram().GetSampleCount() > 0, Equals, true)
+}
+
+func (s MySuite) TestServeHTTPPassHeaders(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"tenant": "#!/bin/sh\necho \"a{tenant=\\\"$HTTP_X_TENANT_ID\\\",auth=\\\"$HTTP_AUTHORIZATION\\\"} 1\"\n" +
+			`case "$SCRIPT_REQUEST" in *'"X-Tenant-Id":["acme"]'*) echo 'request_env 1';; esac` + "\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{},
+		&Config{Scripts: map[string]ScriptConfig{"tenant": {PassHeaders: []string{"X-Tenant-ID"}}}})
+	go sh.Start()
+
+	r := httptest.NewRequest("GET", "/metrics/tenant", nil)
+	r.Header.Set("X-Tenant-ID", "acme")
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, 200)
+	c.Check(w.Body.String(), Matches, `(?s).*\na{auth="",tenant="acme"} 1\n.*`)
+	c.Check(w.Body.String(), Matches, `(?s).*\nrequest_env 1\n.*`)
+}
+
+func (s MySuite) TestServeHTTPDuration(c *C) {
+	dir := writeScripts(c, map[string]string{"nap": "#!/bin/sh\nsleep 0.2\necho 'a 1'\n"})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{}, nil)
+	go sh.Start()
+
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/nap", nil))
+	c.Assert(w.Code, Equals, 200)
+	c.Check(w.Body.String(), Matches, `(?s).*\nscript_duration_seconds 0\.[2-9][0-9]*\n.*`)
+}
+
+func (s MySuite) TestServeHTTPErrors(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"fail":    "#!/bin/sh\nexit 1\n",
+		"garbage": "#!/bin/sh\necho 'not a metric'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{}, nil)
+	go sh.Start()
+
+	for _, script := range []string{"fail", "garbage"} {
+		w := httptest.NewRecorder()
+		sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/"+script, nil))
+		c.Check(w.Code, Equals, 500)
+		c.Check(w.Body.String(), Matches, `error .* script '`+script+`' \(request id [0-9a-f]{8}\)\n`)
+	}
+}
+
+func (s MySuite) TestServeHTTPUnknownScript(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"known": "#!/bin/sh\necho 'a 1'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{}, nil)
+	go sh.Start()
+
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/known", nil))
+	c.Check(w.Code, Equals, 200)
+
+	// Requesting a script that doesn't exist creates no timeseries.
+	for _, script := range []string{"bogus_script", "sub/bogus_script"} {
+		w = httptest.NewRecorder()
+		sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/"+script, nil))
+		c.Check(w.Code, Equals, 404)
+	}
+	fams, err := prometheus.DefaultGatherer.Gather()
+	c.Assert(err, IsNil)
+	for _, fam := range fams {
+		for _, m := range fam.Metric {
+			for _, lp := range m.Label {
+				c.Check(strings.Contains(lp.GetValue(), "bogus_script"), Equals, false, Commentf("%s", fam.GetName()))
+			}
+		}
+	}
+}
+
+func (s MySuite) TestDispatcher(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"dispatch": "#!/bin/sh\necho \"dispatched{name=\\\"$1\\\",args=\\\"$#\\\"} 1\"\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", path.Join(dir, "dispatch"), parseOpts{}, 1, 5*time.Second, ScriptConfig{},
+		&Config{Scripts: map[string]ScriptConfig{"disk": {Args: []string{"{{.Param.dev}}"}}}})
+	sh.dispatcher = true
+	go sh.Start()
+
+	for url, want := range map[string]string{
+		"/metrics/cpu":          `dispatched{args="1",name="cpu"} 1`,
+		"/metrics/disk?dev=sda": `dispatched{args="2",name="disk"} 1`,
+	} {
+		w := httptest.NewRecorder()
+		sh.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		c.Assert(w.Code, Equals, 200, Commentf("%s", url))
+		c.Check(w.Body.String(), Matches, "(?s).*\\n"+regexp.QuoteMeta(want)+"\\n.*", Commentf("%s", url))
+	}
+}
+
+func (s MySuite) TestMaxScripts(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"capped1": "#!/bin/sh\necho 'a 1'\n",
+		"capped2": "#!/bin/sh\necho 'a 1'\n",
+		"capped3": "#!/bin/sh\necho 'a 1'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{},
+		&Config{Scripts: map[string]ScriptConfig{"capped3": {}}})
+	sh.maxScripts = 1
+	go sh.Start()
+
+	scrape := func(script string) int {
+		w := httptest.NewRecorder()
+		sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/"+script, nil))
+		return w.Code
+	}
+	c.Check(scrape("capped1"), Equals, 200)
+	c.Check(scrape("capped1"), Equals, 200)
+	// A second unconfigured script exceeds the limit; configured ones don't
+	// count towards it.
+	c.Check(scrape("capped2"), Equals, 404)
+	c.Check(scrape("capped3"), Equals, 200)
+}
+
+func (s MySuite) TestDisabledScript(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"switched": "#!/bin/sh\ncd \"$(dirname \"$0\")\"\ntouch ran\necho 'a 1'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	zero := 0
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{},
+		&Config{Scripts: map[string]ScriptConfig{"switched": {Workers: &zero}}})
+	go sh.Start()
+
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/switched", nil))
+	c.Check(w.Code, Equals, 403)
+	c.Check(w.Body.String(), Matches, "script 'switched' is disabled\n")
+	_, err := os.Stat(path.Join(dir, "ran"))
+	c.Check(os.IsNotExist(err), Equals, true)
+	var m dto.Metric
+	c.Assert(mDisabledRequests.WithLabelValues("switched").Write(&m), IsNil)
+	c.Check(m.GetCounter().GetValue(), Equals, 1.0)
+
+	// Reloading the config can enable it again.
+	sh.setConfig(&Config{Scripts: map[string]ScriptConfig{"switched": {}}})
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/switched", nil))
+	c.Check(w.Code, Equals, 200)
+	_, err = os.Stat(path.Join(dir, "ran"))
+	c.Check(err, IsNil)
+}
+
+func (s MySuite) TestCanceledVsTimeout(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"abandoned": "#!/bin/sh\nsleep 5\n",
+		"overdue":   "#!/bin/sh\nsleep 5\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 300*time.Millisecond, ScriptConfig{}, nil)
+	go sh.Start()
+	value := func(vec *prometheus.CounterVec, script string) float64 {
+		var m dto.Metric
+		c.Assert(vec.WithLabelValues(script).Write(&m), IsNil)
+		return m.GetCounter().GetValue()
+	}
+
+	// The client going away cancels the script without it counting as an
+	// error.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	sh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics/abandoned", nil).WithContext(ctx))
+	c.Check(value(mCanceled, "abandoned"), Equals, 1.0)
+	c.Check(value(mErrors, "abandoned"), Equals, 0.0)
+	c.Check(value(mTimeouts, "abandoned"), Equals, 0.0)
+	var m dto.Metric
+	c.Assert(mScrapeOutcomes.WithLabelValues("abandoned", outcomeCanceled).Write(&m), IsNil)
+	c.Check(m.GetCounter().GetValue(), Equals, 1.0)
+
+	// Whereas timing out does.
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/overdue", nil))
+	c.Check(w.Code, Equals, 500)
+	c.Check(value(mCanceled, "overdue"), Equals, 0.0)
+	c.Check(value(mErrors, "overdue"), Equals, 1.0)
+	c.Check(value(mTimeouts, "overdue"), Equals, 1.0)
+}
+
+func (s MySuite) TestServeOnTimeout(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"laggard": "#!/bin/bash\ntrap 'echo late 1; exit 1' TERM\necho early 1\nsleep 5 & wait\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sc := ScriptConfig{Timeout: 300 * time.Millisecond, HardTimeout: 2 * time.Second}
+	config := &Config{Scripts: map[string]ScriptConfig{"laggard": sc}}
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{}, config)
+	go sh.Start()
+
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/laggard", nil))
+	c.Check(w.Code, Equals, 500)
+
+	// Output written before and in response to SIGTERM is served.
+	sc.ServeOnTimeout = true
+	sh.setConfig(&Config{Scripts: map[string]ScriptConfig{"laggard": sc}})
+	start := time.Now()
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/laggard", nil))
+	c.Check(time.Since(start) < time.Second, Equals, true)
+	c.Check(w.Code, Equals, 200)
+	body := w.Body.String()
+	c.Check(body, Matches, "(?s).*\nearly 1\n.*")
+	c.Check(body, Matches, "(?s).*\nlate 1\n.*")
+	c.Check(body, Matches, "(?s).*\nscript_success 0\n.*")
+}
+
+func (s MySuite) TestServeHTTPPathArgs(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"disk": "#!/bin/sh\necho \"args{a=\\\"$*\\\"} $#\"\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{}, nil)
+	go sh.Start()
+
+	// By default the whole remaining path names the script.
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/disk/sda1", nil))
+	c.Check(w.Code, Equals, 404)
+
+	sh.pathArgs = true
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/disk/sda1/p2", nil))
+	c.Assert(w.Code, Equals, 200)
+	c.Check(w.Body.String(), Matches, `(?s).*\nargs{a="sda1 p2"} 2\n.*`)
+
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/disk/../../bin/sh", nil))
+	c.Check(w.Code, Equals, 400)
+}
+
+func (s MySuite) TestConcurrencyQueue(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"slow": "#!/bin/sh\nsleep 0.5\necho 'a 1'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{}, nil)
+	go sh.Start()
+
+	scrapeTwice := func() []int {
+		codes := make(chan int, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				w := httptest.NewRecorder()
+				sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/slow", nil))
+				codes <- w.Code
+			}()
+		}
+		return []int{<-codes, <-codes}
+	}
+
+	// By default the second concurrent request fails straight away...
+	codes := scrapeTwice()
+	c.Check(codes[0]+codes[1], Equals, 200+500)
+
+	// ...but when queueing it waits for the first to finish.
+	sh.queue = true
+	c.Check(scrapeTwice(), DeepEquals, []int{200, 200})
+
+	// Unless that takes longer than the timeout.
+	sh.timeout = 200 * time.Millisecond
+	codes = scrapeTwice()
+	c.Check(codes[0], Equals, 500)
+	c.Check(codes[1], Equals, 500)
+}
+
+// fakeRunnerHandler returns a ScriptHandler with a single worker per script
+// which runs scripts using runner rather than spawning them.
+func fakeRunnerHandler(runner func(context.Context, commandOpts, string, ...string) (string, error), scripts ...string) *ScriptHandler {
+	config := &Config{Scripts: make(map[string]ScriptConfig)}
+	for _, script := range scripts {
+		config.Scripts[script] = ScriptConfig{}
+	}
+	sh := NewScriptHandler("/metrics", "/nonexistent", parseOpts{}, 1, 5*time.Second, ScriptConfig{}, config)
+	sh.runner = runner
+	go sh.Start()
+	return sh
+}
+
+func (s MySuite) TestFakeRunnerSuccess(c *C) {
+	var ran []string
+	sh := fakeRunnerHandler(func(ctx context.Context, opts commandOpts, script string, args ...string) (string, error) {
+		ran = append(ran, script)
+		return "faked 1\n", nil
+	}, "faked")
+
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/faked", nil))
+	c.Check(w.Code, Equals, 200)
+	c.Check(w.Body.String(), Matches, "(?s).*\nfaked 1\n.*")
+	c.Check(ran, DeepEquals, []string{"/nonexistent/faked"})
+
+	var m dto.Metric
+	c.Assert(mScrapeOutcomes.WithLabelValues("faked", outcomeSuccess).Write(&m), IsNil)
+	c.Check(m.GetCounter().GetValue(), Equals, 1.0)
+}
+
+func (s MySuite) TestFakeRunnerConcurrency(c *C) {
+	started, release := make(chan struct{}), make(chan struct{})
+	sh := fakeRunnerHandler(func(ctx context.Context, opts commandOpts, script string, args ...string) (string, error) {
+		started <- struct{}{}
+		<-release
+		return "fakebusy 1\n", nil
+	}, "fakebusy")
+
+	first := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/fakebusy", nil))
+		first <- w.Code
+	}()
+	<-started
+
+	// With the only worker busy, a second request is rejected without
+	// running the script.
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/fakebusy", nil))
+	c.Check(w.Code, Equals, 500)
+	var m dto.Metric
+	c.Assert(mScrapeOutcomes.WithLabelValues("fakebusy", outcomeConcurrencyRejected).Write(&m), IsNil)
+	c.Check(m.GetCounter().GetValue(), Equals, 1.0)
+
+	close(release)
+	c.Check(<-first, Equals, 200)
+}
+
+func (s MySuite) TestConcurrencyKeyArgs(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"bytarget": "#!/bin/sh\nsleep 0.5\necho 'a 1'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{},
+		&Config{Scripts: map[string]ScriptConfig{"bytarget": {
+			Args:           []string{"{{.Param.target}}"},
+			ConcurrencyKey: concurrencyKeyArgs,
+		}}})
+	go sh.Start()
+
+	scrape := func(targets ...string) []int {
+		codes := make(chan int, len(targets))
+		for _, target := range targets {
+			go func(target string) {
+				w := httptest.NewRecorder()
+				sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/bytarget?target="+target, nil))
+				codes <- w.Code
+			}(target)
+		}
+		var result []int
+		for range targets {
+			result = append(result, <-codes)
+		}
+		return result
+	}
+
+	// Requests for distinct targets run in parallel...
+	c.Check(scrape("a", "b"), DeepEquals, []int{200, 200})
+
+	// ...while those for the same target are still limited.
+	codes := scrape("a", "a")
+	c.Check(codes[0]+codes[1], Equals, 200+500)
+
+	// Semaphores are discarded once unused.
+	sh.mtx.Lock()
+	c.Check(sh.slots, HasLen, 0)
+	sh.mtx.Unlock()
+}
+
+func (s MySuite) TestConfigMetrics(c *C) {
+	sh := NewScriptHandler("/metrics", "/nonexistent", parseOpts{}, 3, 7*time.Second, ScriptConfig{}, nil)
+	sh.setConfig(&Config{AllScripts: []string{"a"}, Scripts: map[string]ScriptConfig{"b": {}}})
+
+	for _, script := range []string{"a", "b"} {
+		var m dto.Metric
+		mConfigTimeout.WithLabelValues(script).Write(&m)
+		c.Check(m.GetGauge().GetValue(), Equals, 7.0, Commentf("%s", script))
+		mConfigWorkers.WithLabelValues(script).Write(&m)
+		c.Check(m.GetGauge().GetValue(), Equals, 3.0, Commentf("%s", script))
+	}
+}
+
+func (s MySuite) TestConcurrencyAvailable(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"avail": "#!/bin/sh\nsleep 0.5\necho 'a 1'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	available := func() float64 {
+		var m dto.Metric
+		mConcAvailable.WithLabelValues("avail").Write(&m)
+		return m.GetGauge().GetValue()
+	}
+	waitFor := func(want float64) {
+		deadline := time.Now().Add(5 * time.Second)
+		for available() != want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Check(available(), Equals, want)
+	}
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 2, 5*time.Second, ScriptConfig{},
+		&Config{Scripts: map[string]ScriptConfig{"avail": {}}})
+	go sh.Start()
+	waitFor(2)
+
+	done := make(chan struct{})
+	go func() {
+		sh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics/avail", nil))
+		close(done)
+	}()
+	waitFor(1)
+	<-done
+	c.Check(available(), Equals, 2.0)
+}
+
+func (s MySuite) TestServeHTTPRoutes(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"node.sh": "#!/bin/sh\necho \"node{a=\\\"$1\\\"} 1\"\n",
+	})
+	defer os.RemoveAll(dir)
+
+	cfg := &Config{Routes: []Route{{Path: `^/metrics/node/(\w+)$`, Script: "node.sh"}}}
+	cfg.Routes[0].re = regexp.MustCompile(cfg.Routes[0].Path)
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{}, cfg)
+	go sh.Start()
+
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/node/cpu", nil))
+	c.Assert(w.Code, Equals, 200)
+	c.Check(w.Body.String(), Matches, `(?s).*\nnode{a="cpu"} 1\n.*`)
+
+	// Paths not matching any route are resolved as usual.
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/node.sh", nil))
+	c.Assert(w.Code, Equals, 200)
+	c.Check(w.Body.String(), Matches, `(?s).*\nnode{a=""} 1\n.*`)
+}
+
+func (s MySuite) TestServeHTTPArgTemplates(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"probe": "#!/bin/sh\necho \"args{a=\\\"$*\\\"} $#\"\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{},
+		&Config{Scripts: map[string]ScriptConfig{"probe": {Args: []string{"--target={{.Param.target}}"}}}})
+	go sh.Start()
+
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/probe?target=db1", nil))
+	c.Assert(w.Code, Equals, 200)
+	c.Check(w.Body.String(), Matches, `(?s).*\nargs{a="--target=db1"} 1\n.*`)
+
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/probe", nil))
+	c.Check(w.Code, Equals, 500)
+
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/probe?target=db%0A1", nil))
+	c.Check(w.Code, Equals, 400)
+}
+
+func (s MySuite) TestServeHTTPEmptyOutput(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"empty":  "#!/bin/sh\necho\n",
+		"empty2": "#!/bin/sh\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{},
+		&Config{Scripts: map[string]ScriptConfig{"empty2": {EmptyOutputIsError: true}}})
+	go sh.Start()
+
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/empty", nil))
+	c.Check(w.Code, Equals, 200)
+	var m dto.Metric
+	mEmptyOutput.WithLabelValues("empty").Write(&m)
+	c.Check(m.GetCounter().GetValue(), Equals, 1.0)
+
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/empty2", nil))
+	c.Check(w.Code, Equals, 500)
+	c.Check(w.Body.String(), Matches, `error parsing output from script 'empty2'.*\n`)
+}
+
+func (s MySuite) TestServeHTTPHideSelfMetrics(c *C) {
+	sh := NewScriptHandler("/metrics", "/nonexistent", parseOpts{}, 1, 5*time.Second, ScriptConfig{}, &Config{})
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/", nil))
+	c.Check(w.Code, Equals, 200)
+
+	sh.hideSelfMetrics = true
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/", nil))
+	c.Check(w.Code, Equals, 404)
+}
+
+func (s MySuite) TestPprofHandler(c *C) {
+	w := httptest.NewRecorder()
+	pprofHandler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	c.Check(w.Code, Equals, 200)
+	c.Check(w.Body.String(), Matches, `(?s).*goroutine.*`)
+}
+
+func (s MySuite) TestServeHTTPGzip(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"big": "#!/bin/sh\nfor i in $(seq 100); do echo \"a{i=\\\"$i\\\"} $i\"; done\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{},
+		&Config{AllScripts: []string{"big"}})
+	go sh.Start()
+
+	for _, url := range []string{"/metrics/big", "/metrics/all"} {
+		r := httptest.NewRequest("GET", url, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		sh.ServeHTTP(w, r)
+		c.Assert(w.Code, Equals, 200)
+		c.Check(w.Header().Get("Content-Encoding"), Equals, "gzip")
+		gz, err := gzip.NewReader(w.Body)
+		c.Assert(err, IsNil)
+		body, err := ioutil.ReadAll(gz)
+		c.Assert(err, IsNil)
+		c.Check(string(body), Matches, `(?s).*\na{i="100"(,script_name="big")?} 100\n.*`)
+
+		// Clients not asking for compression don't get it.
+		w = httptest.NewRecorder()
+		sh.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		c.Check(w.Header().Get("Content-Encoding"), Equals, "")
+		c.Check(w.Body.String(), Matches, `(?s).*\na{i="100"(,script_name="big")?} 100\n.*`)
+	}
+}
+
+func (s MySuite) TestTimeoutCommand(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"hang": "#!/bin/sh\nsleep 5\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 200*time.Millisecond, ScriptConfig{Workdir: dir},
+		&Config{Scripts: map[string]ScriptConfig{"hang": {
+			TimeoutCommand: []string{"sh", "-c", `echo "$0" > cleaned`},
+		}}})
+	go sh.Start()
+
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/hang", nil))
+	c.Check(w.Code, Equals, 500)
+
+	var cleaned []byte
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var err error
+		if cleaned, err = ioutil.ReadFile(path.Join(dir, "cleaned")); err == nil && len(cleaned) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(string(cleaned), Equals, path.Join(dir, "hang")+"\n")
+}
+
+func (s MySuite) TestExpectedMetrics(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"drifted": "#!/bin/sh\necho 'a 1'\necho 'c 3'\n",
+		"matches": "#!/bin/sh\necho 'a 1'\necho 'b 2'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	expected := []string{"a", "b"}
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{ExpectedMetrics: expected}, nil)
+	go sh.Start()
+
+	violations := func(script string) float64 {
+		var m dto.Metric
+		mSchemaViolations.WithLabelValues(script).Write(&m)
+		return m.GetCounter().GetValue()
+	}
+	for script, want := range map[string]float64{"drifted": 1, "matches": 0} {
+		w := httptest.NewRecorder()
+		sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/"+script, nil))
+		c.Check(w.Code, Equals, 200)
+		c.Check(violations(script), Equals, want, Commentf("%s", script))
+	}
+
+	unexpected, missing := schemaViolations(expected, []string{"a", "c"})
+	c.Check(unexpected, DeepEquals, []string{"c"})
+	c.Check(missing, DeepEquals, []string{"b"})
+}
+
+func (s MySuite) TestRepeat(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"sample": "#!/bin/sh\ncd \"$(dirname \"$0\")\"\nn=$(($(cat count 2>/dev/null || echo 0) + 1))\necho $n > count\necho \"a $n\"\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{},
+		&Config{Scripts: map[string]ScriptConfig{"sample": {Repeat: 3, Aggregate: aggregateMax}}})
+	go sh.Start()
+
+	// The runs output 1, 2 and 3, then 4, 5 and 6.
+	for _, want := range []string{"a 3\n", "a 6\n"} {
+		w := httptest.NewRecorder()
+		sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/sample", nil))
+		c.Assert(w.Code, Equals, 200)
+		c.Check(w.Body.String(), Matches, "(?s).*\\n"+want+".*")
+	}
+}
+
+func (s MySuite) TestCircuitBreaker(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"breaker": "#!/bin/sh\ncd \"$(dirname \"$0\")\"\necho x >> runs\n[ -f fixed ] && echo 'a 1'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{},
+		&Config{Scripts: map[string]ScriptConfig{"breaker": {CircuitBreakerFailures: 2, CircuitBreakerCooldown: 200 * time.Millisecond}}})
+	go sh.Start()
+
+	scrape := func() int {
+		w := httptest.NewRecorder()
+		sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/breaker", nil))
+		return w.Code
+	}
+	runs := func() int {
+		b, _ := ioutil.ReadFile(path.Join(dir, "runs"))
+		return len(b) / 2
+	}
+	opened := func() float64 {
+		var m dto.Metric
+		mCircuitOpen.WithLabelValues("breaker").Write(&m)
+		return m.GetCounter().GetValue()
+	}
+
+	// After two failures the circuit opens and the script isn't run.
+	for i := 0; i < 4; i++ {
+		c.Check(scrape(), Equals, 500)
+	}
+	c.Check(runs(), Equals, 2)
+	c.Check(opened(), Equals, 2.0)
+
+	// After the cooldown a failed trial run opens it again, for longer.
+	time.Sleep(250 * time.Millisecond)
+	c.Check(scrape(), Equals, 500)
+	c.Check(runs(), Equals, 3)
+	time.Sleep(250 * time.Millisecond)
+	c.Check(scrape(), Equals, 500)
+	c.Check(runs(), Equals, 3)
+
+	// A successful trial run closes it.
+	c.Assert(ioutil.WriteFile(path.Join(dir, "fixed"), nil, 0644), IsNil)
+	time.Sleep(250 * time.Millisecond)
+	c.Check(scrape(), Equals, 200)
+	c.Check(scrape(), Equals, 200)
+	c.Check(runs(), Equals, 5)
+	c.Check(opened(), Equals, 3.0)
+}
+
+func (s MySuite) TestFilterCommand(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"filtered":   "#!/bin/sh\necho 'a 1'\necho 'debug 2'\n",
+		"filter_bad": "#!/bin/sh\necho 'a 1'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{},
+		&Config{Scripts: map[string]ScriptConfig{
+			"filtered":   {FilterCommand: []string{"grep", "-v", "debug"}},
+			"filter_bad": {FilterCommand: []string{"sh", "-c", "cat; exit 3"}},
+		}})
+	go sh.Start()
+
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/filtered", nil))
+	c.Assert(w.Code, Equals, 200)
+	c.Check(w.Body.String(), Matches, "(?s).*\\na 1\\n.*")
+	c.Check(w.Body.String(), Not(Matches), "(?s).*debug.*")
+
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/filter_bad", nil))
+	c.Check(w.Code, Equals, 500)
+	var m dto.Metric
+	mFilterErrors.WithLabelValues("filter_bad").Write(&m)
+	c.Check(m.GetCounter().GetValue(), Equals, 1.0)
+	mScrapeOutcomes.WithLabelValues("filter_bad", outcomeFilterError).Write(&m)
+	c.Check(m.GetCounter().GetValue(), Equals, 1.0)
+}
+
+func (s MySuite) TestHostnameLabel(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"hostlabel":  "#!/bin/sh\necho 'a 1'\n",
+		"hostlabel2": "#!/bin/sh\necho 'a 1'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	parse := parseOpts{labels: map[string]string{"host": "web1"}}
+	sh := NewScriptHandler("/metrics", dir, parse, 1, 5*time.Second, ScriptConfig{},
+		&Config{Scripts: map[string]ScriptConfig{"hostlabel2": {Labels: map[string]string{"host": "override", "env": "prod"}}}})
+	go sh.Start()
+
+	for script, want := range map[string]string{
+		"hostlabel":  `a{host="web1"} 1`,
+		"hostlabel2": `a{env="prod",host="override"} 1`,
+	} {
+		w := httptest.NewRecorder()
+		sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/"+script, nil))
+		c.Assert(w.Code, Equals, 200)
+		c.Check(w.Body.String(), Matches, "(?s).*\\n"+regexp.QuoteMeta(want)+"\\n.*", Commentf("%s", script))
+	}
+}
+
+func (s MySuite) TestParseErrorInfo(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"flaky": "#!/bin/sh\nif [ -f fixed ]; then echo 'a 1'; else echo 'a{ 1'; fi\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{Workdir: dir}, nil)
+	go sh.Start()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(mParseErrorInfo)
+	errorLabels := func() []string {
+		fams, err := reg.Gather()
+		c.Assert(err, IsNil)
+		var labels []string
+		for _, fam := range fams {
+			for _, m := range fam.Metric {
+				if m.Label[1].GetValue() == "flaky" {
+					labels = append(labels, m.Label[0].GetValue())
+				}
+			}
+		}
+		return labels
+	}
+
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/flaky", nil))
+	c.Check(w.Code, Equals, 500)
+	labels := errorLabels()
+	c.Assert(labels, HasLen, 1)
+	c.Check(labels[0], Matches, "Error parsing Prometheus TextFormat: .*")
+	c.Check(len(labels[0]) <= maxParseErrorInfo, Equals, true)
+
+	c.Assert(ioutil.WriteFile(path.Join(dir, "fixed"), nil, 0644), IsNil)
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/flaky", nil))
+	c.Check(w.Code, Equals, 200)
+	c.Check(errorLabels(), HasLen, 0)
+}
+
+func (s MySuite) TestServeHTTPOutputFile(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"tofile":  "#!/bin/sh\necho 'a 1' > out.prom\necho 'b 2'\n",
+		"nofile":  "#!/bin/sh\necho 'b 2'\n",
+		"failing": "#!/bin/sh\necho 'a 1' > failing.prom\nexit 1\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{Workdir: dir},
+		&Config{Scripts: map[string]ScriptConfig{
+			"tofile":  {OutputFile: "out.prom"},
+			"nofile":  {OutputFile: "out2.prom"},
+			"failing": {OutputFile: path.Join(dir, "failing.prom"), RemoveOutputFile: true},
+		}})
+	go sh.Start()
+
+	// Metrics are read from the file rather than stdout.
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/tofile", nil))
+	c.Check(w.Code, Equals, 200)
+	c.Check(w.Body.String(), Matches, `(?s).*\na 1\n.*`)
+	c.Check(w.Body.String(), Not(Matches), `(?s).*\nb 2\n.*`)
+	_, err := os.Stat(path.Join(dir, "out.prom"))
+	c.Check(err, IsNil)
+
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/nofile", nil))
+	c.Check(w.Code, Equals, 500)
+
+	// The file is removed even if the script fails.
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/failing", nil))
+	c.Check(w.Code, Equals, 500)
+	_, err = os.Stat(path.Join(dir, "failing.prom"))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s MySuite) TestServeHTTPVerboseErrors(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"fail": "#!/bin/sh\necho oops >&2\nexit 1\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{VerboseErrors: true}, nil)
+	go sh.Start()
+
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/fail", nil))
+	c.Check(w.Code, Equals, 500)
+	c.Check(w.Body.String(), Matches, `error running script 'fail' \(request id [0-9a-f]{8}\): exit status 1\nstderr:\noops\n\n`)
+}
+
+func (s MySuite) TestScrapeOutcomes(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"outcome_good":    "#!/bin/sh\necho 'a 1'\n",
+		"outcome_bad":     "#!/bin/sh\nexit 1\n",
+		"outcome_garbled": "#!/bin/sh\necho 'a{ 1'\n",
+		"outcome_slow":    "#!/bin/sh\nexec sleep 5\n",
+		"outcome_hold":    "#!/bin/sh\nsleep 0.5\necho 'a 1'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, time.Second, ScriptConfig{}, nil)
+	go sh.Start()
+
+	scrape := func(script string) {
+		sh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics/"+script, nil))
+	}
+	outcomes := func(script, outcome string) float64 {
+		var m dto.Metric
+		mScrapeOutcomes.WithLabelValues(script, outcome).Write(&m)
+		return m.GetCounter().GetValue()
+	}
+
+	running := func() float64 {
+		var m dto.Metric
+		mRunning.WithLabelValues("outcome_hold").Write(&m)
+		return m.GetGauge().GetValue()
+	}
+
+	// A scrape made while the script is already running is rejected.
+	done := make(chan struct{})
+	go func() {
+		scrape("outcome_hold")
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for running() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	scrape("outcome_hold")
+	<-done
+	c.Check(outcomes("outcome_hold", outcomeConcurrencyRejected), Equals, 1.0)
+	c.Check(outcomes("outcome_hold", outcomeSuccess), Equals, 1.0)
+
+	for script, outcome := range map[string]string{
+		"outcome_good":    outcomeSuccess,
+		"outcome_bad":     outcomeError,
+		"outcome_garbled": outcomeParseError,
+		"outcome_slow":    outcomeTimeout,
+	} {
+		scrape(script)
+		c.Check(outcomes(script, outcome), Equals, 1.0, Commentf("%s", script))
+	}
+	var m dto.Metric
+	mCacheServed.WithLabelValues("outcome_good").Write(&m)
+	c.Check(m.GetGauge(), NotNil)
+	c.Check(m.GetGauge().GetValue(), Equals, 0.0)
+}
+
+func (s MySuite) TestScheduledScript(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"sched": "#!/bin/sh\necho run >> runs\necho 'a 1'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{Workdir: dir},
+		&Config{Scripts: map[string]ScriptConfig{"sched": {Interval: time.Hour}}})
+	go sh.Start()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sh.mtx.Lock()
+		_, ok := sh.cache["sched"]
+		sh.mtx.Unlock()
+		if ok || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Scrapes are served from the cache rather than running the script again.
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/sched", nil))
+		c.Assert(w.Code, Equals, 200)
+		c.Check(w.Body.String(), Matches, `(?s).*\na 1\n.*`)
+	}
+	runs, err := ioutil.ReadFile(path.Join(dir, "runs"))
+	c.Assert(err, IsNil)
+	c.Check(string(runs), Equals, "run\n")
+
+	// Serving from the cache records how old the result served was.
+	var m dto.Metric
+	mCacheServedAge.WithLabelValues("sched").Write(&m)
+	c.Check(m.GetGauge().GetValue() > 0, Equals, true)
+	c.Check(m.GetGauge().GetValue() < 5, Equals, true)
+	m = dto.Metric{}
+	mScrapeOutcomes.WithLabelValues("sched", outcomeCacheHit).Write(&m)
+	c.Check(m.GetCounter().GetValue(), Equals, 2.0)
+	mCacheServed.WithLabelValues("sched").Write(&m)
+	c.Check(m.GetGauge().GetValue(), Equals, 1.0)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(sh)
+	fams, err := reg.Gather()
+	c.Assert(err, IsNil)
+	c.Assert(len(fams), Equals, 1)
+	c.Check(fams[0].GetName(), Equals, "script_cache_age_seconds")
+	c.Check(fams[0].Metric[0].GetGauge().GetValue() < 5, Equals, true)
+}
+
+func (s MySuite) TestScheduleOffset(c *C) {
+	for i := 0; i < 100; i++ {
+		offset := scheduleOffset(time.Minute, 0.5)
+		c.Assert(offset >= 0 && offset < 30*time.Second, Equals, true, Commentf("%v", offset))
+	}
+	c.Check(scheduleOffset(time.Minute, 0), Equals, time.Duration(0))
+}
+
+func (s MySuite) TestScheduledScriptPush(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"sched": "#!/bin/sh\necho 'a 1'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	pushed := make(chan *http.Request, 1)
+	pgw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushed <- r
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer pgw.Close()
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{},
+		&Config{Scripts: map[string]ScriptConfig{"sched": {Interval: time.Hour, PushgatewayURL: pgw.URL}}})
+	go sh.Start()
+
+	select {
+	case r := <-pushed:
+		c.Check(r.Method, Equals, "PUT")
+		c.Check(r.URL.Path, Matches, `/metrics/job/sched/instance/.+`)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for push")
+	}
+}
+
+func (s MySuite) TestServeOnExitError(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"partial":  "#!/bin/sh\necho 'a 1'\nexit 2\n",
+		"partial2": "#!/bin/sh\necho 'a 1'\nexit 2\n",
+		"ok":       "#!/bin/sh\necho 'a 1'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{},
+		&Config{Scripts: map[string]ScriptConfig{
+			"partial": {ServeOnExitError: true},
+			"ok":      {ServeOnExitError: true},
+		}})
+	go sh.Start()
+
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/partial", nil))
+	c.Assert(w.Code, Equals, 200)
+	c.Check(w.Body.String(), Matches, `(?s).*\na 1\n.*`)
+	c.Check(w.Body.String(), Matches, `(?s).*\nscript_success 0\n.*`)
+
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/ok", nil))
+	c.Assert(w.Code, Equals, 200)
+	c.Check(w.Body.String(), Matches, `(?s).*\nscript_success 1\n.*`)
+
+	// Without the option, a nonzero exit is still a failure.
+	w = httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/partial2", nil))
+	c.Check(w.Code, Equals, 500)
+}
+
+func (s MySuite) TestSuccessRegex(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"good":    "#!/bin/sh\necho 'a 1'\necho '# status: OK'\n",
+		"bad":     "#!/bin/sh\necho 'a 1'\necho '# status: FAILED'\n",
+		"dropped": "#!/bin/sh\necho 'a 1'\necho '# status: FAILED'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	config, err := parseConfig([]byte(`scripts:
+  good:
+    success_regex: '(?m)^# status: OK$'
+  bad:
+    success_regex: '(?m)^# status: OK$'
+  dropped:
+    success_regex: '(?m)^# status: OK$'
+    success_regex_drop_metrics: true
+`), "config.yml")
+	c.Assert(err, IsNil)
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{}, config)
+	go sh.Start()
+
+	for script, want := range map[string][]string{
+		"good":    {"a 1", "script_success 1"},
+		"bad":     {"a 1", "script_success 0"},
+		"dropped": {"script_success 0"},
+	} {
+		w := httptest.NewRecorder()
+		sh.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/"+script, nil))
+		c.Assert(w.Code, Equals, 200)
+		for _, line := range want {
+			c.Check(w.Body.String(), Matches, `(?s).*\n`+line+`\n.*`, Commentf("%s", script))
+		}
+		if script == "dropped" {
+			c.Check(w.Body.String(), Not(Matches), `(?s).*\na 1\n.*`)
+		}
+	}
+
+	_, err = parseConfig([]byte("scripts:\n  a:\n    success_regex: '('\n"), "config.yml")
+	c.Check(err, Not(IsNil))
+}
+
+func (s MySuite) TestScrapeTimeout(c *C) {
+	header := func(v string) *http.Request {
+		r := httptest.NewRequest("GET", "/metrics/sleepy", nil)
+		r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", v)
+		return r
+	}
+	offset := 500 * time.Millisecond
+	c.Check(scrapeTimeout(httptest.NewRequest("GET", "/metrics/sleepy", nil), offset), Equals, time.Duration(0))
+	c.Check(scrapeTimeout(header("x"), offset), Equals, time.Duration(0))
+	c.Check(scrapeTimeout(header("-1"), offset), Equals, time.Duration(0))
+	c.Check(scrapeTimeout(header("10"), offset), Equals, 10*time.Second-offset)
+	c.Check(scrapeTimeout(header("10"), 0), Equals, 10*time.Second)
+	c.Check(scrapeTimeout(header("0.2"), offset), Equals, 200*time.Millisecond)
+
+	dir := writeScripts(c, map[string]string{"sleepy": "#!/bin/sh\nexec sleep 5\n"})
+	defer os.RemoveAll(dir)
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, time.Minute, ScriptConfig{}, nil)
+	sh.timeoutOffset = time.Second
+	go sh.Start()
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, header("2"))
+	c.Check(w.Code, Equals, 500)
+	c.Check(time.Since(start) < 2*time.Second, Equals, true)
+}
+
+func (s MySuite) TestSelftest(c *C) {
+	for _, opentsdb := range []bool{false, true} {
+		w := httptest.NewRecorder()
+		selftestHandler(parseOpts{opentsdb: opentsdb}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics/selftest", nil))
+		c.Assert(w.Code, Equals, 200)
+		c.Check(w.Body.String(), Matches, `(?s).*\nscript_exporter_selftest_up 1\n.*`)
+		c.Check(w.Body.String(), Matches, `(?s).*\nscript_exporter_selftest_time_seconds \S+\n.*`)
+	}
+}
+
+func (s MySuite) TestServerWriteTimeout(c *C) {
+	c.Check(serverWriteTimeout(0, time.Minute), Equals, time.Minute+writeTimeoutMargin)
+	c.Check(serverWriteTimeout(5*time.Second, time.Minute), Equals, time.Minute+writeTimeoutMargin)
+	c.Check(serverWriteTimeout(5*time.Minute, time.Minute), Equals, 5*time.Minute)
+
+	c.Check(runTime(time.Minute, ScriptConfig{}), Equals, time.Minute+stdoutDrainTimeout)
+	c.Check(runTime(time.Minute, ScriptConfig{KillGracePeriod: 10 * time.Second}), Equals, 70*time.Second+stdoutDrainTimeout)
+	c.Check(runTime(time.Minute, ScriptConfig{Repeat: 3}), Equals, 3*(time.Minute+stdoutDrainTimeout))
+	c.Check(runTime(time.Minute, ScriptConfig{Timeout: 2 * time.Minute}), Equals, 2*time.Minute+stdoutDrainTimeout)
+	c.Check(runTime(time.Minute, ScriptConfig{HardTimeout: 3 * time.Minute, KillGracePeriod: time.Hour}), Equals, 3*time.Minute+stdoutDrainTimeout)
+
+	sh := NewScriptHandler("/metrics", "/nonexistent", parseOpts{}, 1, time.Minute, ScriptConfig{}, nil)
+	c.Check(sh.longestRunTime(nil), Equals, time.Minute+stdoutDrainTimeout)
+	config := &Config{Scripts: map[string]ScriptConfig{
+		"quick": {Timeout: time.Second},
+		"slow":  {Timeout: time.Minute, HardTimeout: 5 * time.Minute},
+	}}
+	c.Check(sh.longestRunTime(config), Equals, 5*time.Minute+stdoutDrainTimeout)
+}
+
+// A script which takes longer than the old fixed 5s write timeout must still
+// have its output served in full.
+func (s MySuite) TestSlowScriptNotCutOff(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"slow": "#!/bin/sh\nsleep 6\necho 'a 1'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	timeout := 10 * time.Second
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, timeout, ScriptConfig{}, nil)
+	go sh.Start()
+
+	srv := httptest.NewUnstartedServer(sh)
+	srv.Config.ReadTimeout = 5 * time.Second
+	srv.Config.WriteTimeout = serverWriteTimeout(5*time.Second, runTime(timeout, ScriptConfig{}))
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics/slow")
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, 200)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Check(string(body), Matches, `(?s).*\na 1\n.*`)
+}
+
+// A script whose own timeout is longer than the default must still have its
+// output served in full.
+func (s MySuite) TestSlowScriptTimeoutNotCutOff(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"slower": "#!/bin/sh\nsleep 7\necho 'a 1'\n",
+	})
+	defer os.RemoveAll(dir)
+
+	config := &Config{Scripts: map[string]ScriptConfig{"slower": {Timeout: 10 * time.Second}}}
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 100*time.Millisecond, ScriptConfig{}, config)
+	go sh.Start()
+
+	srv := httptest.NewUnstartedServer(sh)
+	srv.Config.ReadTimeout = 5 * time.Second
+	srv.Config.WriteTimeout = serverWriteTimeout(5*time.Second, sh.longestRunTime(config))
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics/slower")
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, 200)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Check(string(body), Matches, `(?s).*\na 1\n.*`)
+}
+
+func (s MySuite) TestLimitRequests(c *C) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	h := limitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}), 2)
+
+	done := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/a", nil))
+			done <- w.Code
+		}()
+	}
+	<-started
+	<-started
+
+	var m dto.Metric
+	mRequestsRejected.Write(&m)
+	before := m.GetCounter().GetValue()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/a", nil))
+	c.Check(w.Code, Equals, 503)
+	mRequestsRejected.Write(&m)
+	c.Check(m.GetCounter().GetValue(), Equals, before+1)
+
+	close(release)
+	c.Check(<-done, Equals, 200)
+	c.Check(<-done, Equals, 200)
+
+	// Once the earlier requests are done, there's room again.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/a", nil))
+	c.Check(w.Code, Equals, 200)
+}
+
+func (s MySuite) TestAddressFlags(c *C) {
+	af := &addressFlags{addrs: []string{":9661"}}
+	c.Assert(af.Set("127.0.0.1:9661"), IsNil)
+	c.Assert(af.Set("[::1]:9661"), IsNil)
+	c.Check(af.addrs, DeepEquals, []string{"127.0.0.1:9661", "[::1]:9661"})
+
+	af = &addressFlags{addrs: []string{":9661"}}
+	c.Assert(af.Set(""), IsNil)
+	c.Check(af.addrs, HasLen, 0)
+}
+
+func (s MySuite) TestWithHeaders(c *C) {
+	headers := headerFlags{}
+	c.Assert(headers.Set("Cache-Control: no-store"), IsNil)
+	c.Assert(headers.Set("X-Foo:bar"), IsNil)
+	c.Assert(headers.Set("Content-Type: text/html"), IsNil)
+	c.Check(headers.Set("no colon"), Not(IsNil))
+
+	dir := writeScripts(c, map[string]string{"ok": "#!/bin/sh\necho 'a 1'\n"})
+	defer os.RemoveAll(dir)
+	sh := NewScriptHandler("/metrics", dir, parseOpts{}, 1, 5*time.Second, ScriptConfig{}, nil)
+	go sh.Start()
+
+	w := httptest.NewRecorder()
+	withHeaders(sh, http.Header(headers)).ServeHTTP(w, httptest.NewRequest("GET", "/metrics/ok", nil))
+	c.Assert(w.Code, Equals, 200)
+	c.Check(w.Header().Get("Cache-Control"), Equals, "no-store")
+	c.Check(w.Header().Get("X-Foo"), Equals, "bar")
+	c.Check(w.Header().Get("Content-Type"), Matches, "text/plain.*")
+}
+
+// BenchmarkScrapeLocking exercises the paths that take sh.mtx on every scrape
+// of a scheduled script, from many goroutines at once.
+func BenchmarkScrapeLocking(b *testing.B) {
+	sh := NewScriptHandler("/metrics", "/nonexistent", parseOpts{}, 1, time.Second, ScriptConfig{},
+		&Config{Scripts: map[string]ScriptConfig{"sched": {Interval: time.Hour}}})
+	sh.cache["sched"] = cachedResult{runresult: runresult{output: "a 1\n"}, time: time.Now()}
+	r := httptest.NewRequest("GET", "/metrics/sched", nil)
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			sh.resultFor(r, "bench", "sched")
+			sh.setParseErrorInfo("sched", "")
+		}
+	})
+}
@@ -3,52 +3,609 @@ package main
 import (
 	"bosun.org/opentsdb"
 	"bufio"
+	"bytes"
 	"fmt"
+	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"math"
 	"net/http"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // serveMetricsFromText interprets text as metrics, either in Opentsdb format or Prometheus
 // text exposition format.  It emits on w what it consumed, as well as meta metrics like
-// script timings.  Error metrics are handled elsewhere, so that we can still return a failure
-// response on w if the script fails.
-func serveMetricsFromText(opentsdb bool, w http.ResponseWriter, r *http.Request, text string) error {
-	reg := prometheus.NewRegistry()
-	gatherers := prometheus.Gatherers{}
-	var collector prometheus.Collector
-	if opentsdb {
-		metrics, err := translateOpenTsdb(text)
+// script timings, which are provided by extra.  Error metrics are handled elsewhere, so that
+// we can still return a failure response on w if the script fails.  It returns
+// statistics about the metrics parsed from text.
+func serveMetricsFromText(opts parseOpts, w http.ResponseWriter, r *http.Request, text string, extra ...prometheus.Gatherer) (parseStats, error) {
+	gatherer, stats, err := gathererFromText(opts, text)
+	if err != nil {
+		return parseStats{}, err
+	}
+	gatherers := append(prometheus.Gatherers{gatherer}, extra...)
+
+	handler := promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})
+	handler.ServeHTTP(w, r)
+	return stats, nil
+}
+
+// parseStats describes the metrics parsed from a script's output.
+type parseStats struct {
+	// timeseries is the number of timeseries parsed.
+	timeseries int
+
+	// oldest is the earliest timestamp given to any sample, or the zero
+	// Time if none had a timestamp.
+	oldest time.Time
+
+	// duration is how long parsing took.
+	duration time.Duration
+
+	// names are the names of the metric families parsed, after any
+	// prefixing and relabeling.
+	names []string
+
+	// skipped is the number of lines of NDJSON output which couldn't be
+	// parsed and were left out.
+	skipped int
+}
+
+// countTimeseries returns the number of timeseries yielded by g, and the
+// names of the metric families they belong to.
+func countTimeseries(g prometheus.Gatherer) (int, []string, error) {
+	fams, err := g.Gather()
+	if err != nil {
+		return 0, nil, err
+	}
+	count := 0
+	names := make([]string, 0, len(fams))
+	for _, fam := range fams {
+		count += len(fam.Metric)
+		names = append(names, fam.GetName())
+	}
+	return count, names, nil
+}
+
+// parseOpts controls how script output is interpreted as metrics.
+type parseOpts struct {
+	// If opentsdb is true, interpret script output as opentsdb text format
+	// instead of Prometheus'.
+	opentsdb bool
+
+	// If ndjson is true, interpret script output as newline-delimited JSON
+	// samples, as described by ndjsonSample.
+	ndjson bool
+
+	// labelValues says what to do with OpenTSDB tag values that don't
+	// belong in a Prometheus label value.
+	labelValues labelValueSanitizer
+
+	// prefix is prepended to the name of every metric.
+	prefix string
+
+	// labels are added to every metric parsed.  If labelsError is true, a
+	// metric which already has one of them is an error; otherwise the
+	// value in labels replaces its own.
+	labels      map[string]string
+	labelsError bool
+
+	// scale gives factors to multiply the values of metrics by, keyed by
+	// their names before prefix is added.
+	scale map[string]float64
+
+	// relabel is applied to the metrics parsed, after prefix and labels.
+	relabel []*RelabelConfig
+
+	// If emptyIsError is true, output that's empty or only whitespace is
+	// a parse error.
+	emptyIsError bool
+
+	// If stripCR is true, CRLF line endings are converted to LF before
+	// parsing, as the Prometheus text parser doesn't accept them.
+	stripCR bool
+
+	// If mergeFamilies is true, a metric family declared more than once in
+	// Prometheus text format output is merged rather than being an error.
+	mergeFamilies bool
+
+	// If quantiles is true, OpenTSDB metrics with percentile suffixes like
+	// _p99 are turned into summaries, as described by summarizeQuantiles.
+	quantiles bool
+
+	// If latin1 is true, script output is in ISO 8859-1 rather than UTF-8,
+	// and is converted before parsing.
+	latin1 bool
+}
+
+// A labelValueSanitizer says what to do with label values containing
+// control characters or invalid UTF-8, which can't be emitted verbatim.
+type labelValueSanitizer string
+
+const (
+	// sanitizeEscape replaces the offending characters with escape
+	// sequences, e.g. a tab becomes \t.  This is the default.
+	sanitizeEscape labelValueSanitizer = "escape"
+	// sanitizeStrip removes the offending characters.
+	sanitizeStrip labelValueSanitizer = "strip"
+	// sanitizeReject treats the offending value as a parse error.
+	sanitizeReject labelValueSanitizer = "reject"
+)
+
+// parseLabelValueSanitizer returns the labelValueSanitizer named s.
+func parseLabelValueSanitizer(s string) (labelValueSanitizer, error) {
+	switch lvs := labelValueSanitizer(s); lvs {
+	case sanitizeEscape, sanitizeStrip, sanitizeReject:
+		return lvs, nil
+	}
+	return "", fmt.Errorf("unknown label value sanitization strategy '%s'", s)
+}
+
+// sanitize returns v modified according to lvs.
+func (lvs labelValueSanitizer) sanitize(v string) (string, error) {
+	if utf8.ValidString(v) && strings.IndexFunc(v, unicode.IsControl) < 0 {
+		return v, nil
+	}
+	if lvs == sanitizeReject {
+		return "", fmt.Errorf("label value %q contains control characters or invalid UTF-8", v)
+	}
+
+	var buf bytes.Buffer
+	for len(v) > 0 {
+		r, size := utf8.DecodeRuneInString(v)
+		switch {
+		case r == utf8.RuneError && size == 1:
+			if lvs != sanitizeStrip {
+				fmt.Fprintf(&buf, `\x%02x`, v[0])
+			}
+		case unicode.IsControl(r):
+			if lvs != sanitizeStrip {
+				q := strconv.QuoteRune(r)
+				buf.WriteString(q[1 : len(q)-1])
+			}
+		default:
+			buf.WriteRune(r)
+		}
+		v = v[size:]
+	}
+	return buf.String(), nil
+}
+
+// gathererFromText interprets text as metrics, either in Opentsdb format or Prometheus
+// text exposition format, and returns a Gatherer yielding them.
+func gathererFromText(opts parseOpts, text string) (prometheus.Gatherer, parseStats, error) {
+	start := time.Now()
+	text, err := prepareText(opts, text)
+	if err != nil {
+		return nil, parseStats{}, err
+	}
+	gatherer, stats, err := parseText(opts, text)
+	if err != nil {
+		return nil, parseStats{}, err
+	}
+	if len(opts.relabel) > 0 {
+		gatherer = relabelGatherer{gatherer, opts.relabel}
+	}
+	stats.timeseries, stats.names, err = countTimeseries(gatherer)
+	if err != nil {
+		return nil, parseStats{}, err
+	}
+	stats.duration = time.Since(start)
+	return gatherer, stats, nil
+}
+
+// prepareText checks that the output of a run of a script isn't empty if
+// that's an error, and converts it to UTF-8 text with Unix line endings, as
+// opts say, ready to be parsed.
+func prepareText(opts parseOpts, text string) (string, error) {
+	if opts.emptyIsError && emptyOutput(text) {
+		return "", fmt.Errorf("script produced no output")
+	}
+	if opts.latin1 {
+		text = latin1ToUTF8(text)
+	}
+	if opts.stripCR {
+		text = stripCR(text)
+	}
+	return text, nil
+}
+
+// latin1ToUTF8 converts text from ISO 8859-1 to UTF-8.  Every byte is a
+// character, whose code point is the byte's value.
+func latin1ToUTF8(text string) string {
+	runes := make([]rune, len(text))
+	for i := 0; i < len(text); i++ {
+		runes[i] = rune(text[i])
+	}
+	return string(runes)
+}
+
+// stripCR returns text with any carriage return at the end of a line removed.
+func stripCR(text string) string {
+	return strings.TrimSuffix(strings.Replace(text, "\r\n", "\n", -1), "\r")
+}
+
+// emptyOutput returns true if text contains nothing but whitespace.
+func emptyOutput(text string) bool {
+	return strings.TrimSpace(text) == ""
+}
+
+// parseText does the work of gathererFromText, except for relabeling.  Of the
+// statistics, it only fills in the earliest timestamp given to any sample, if
+// any, and the number of lines skipped.
+func parseText(opts parseOpts, text string) (prometheus.Gatherer, parseStats, error) {
+	var stats parseStats
+	observe := func(t time.Time) {
+		if stats.oldest.IsZero() || t.Before(stats.oldest) {
+			stats.oldest = t
+		}
+	}
+
+	if opts.ndjson {
+		gatherer, skipped, err := parseNDJSON(opts, text)
+		stats.skipped = skipped
+		return gatherer, stats, err
+	}
+	if opts.opentsdb {
+		dpoints, meta, err := parseOpenTsdb(text)
 		if err != nil {
-			return fmt.Errorf("Error parsing OpenTSDB text format: %v", err)
+			return nil, stats, fmt.Errorf("Error parsing OpenTSDB text format: %v", err)
 		}
-		collector = &sliceCollector{metrics}
-		reg.Register(collector)
-		gatherers = append(gatherers, reg)
+		metrics, err := dpointsToMetrics(dpoints, meta, opts)
+		if err != nil {
+			return nil, stats, fmt.Errorf("Error parsing OpenTSDB text format: %v", err)
+		}
+		for _, dpoint := range dpoints {
+			if dpoint.Timestamp > 0 {
+				observe(opentsdbTime(dpoint.Timestamp))
+			}
+		}
+		reg := prometheus.NewRegistry()
+		reg.Register(&sliceCollector{metrics})
+		return reg, stats, nil
+	}
+
+	var nameToFam map[string]*dto.MetricFamily
+	var err error
+	if opts.mergeFamilies {
+		nameToFam, err = parseMergingFamilies(text)
 	} else {
 		tp := &expfmt.TextParser{}
-		nameToFam, err := tp.TextToMetricFamilies(strings.NewReader(text))
+		nameToFam, err = tp.TextToMetricFamilies(strings.NewReader(text))
+	}
+	if err != nil {
+		return nil, stats, fmt.Errorf("Error parsing Prometheus TextFormat: %v", err)
+	}
+	for _, fam := range nameToFam {
+		for _, m := range fam.Metric {
+			if m.TimestampMs != nil {
+				observe(time.Unix(0, m.GetTimestampMs()*int64(time.Millisecond)))
+			}
+		}
+	}
+	if len(opts.scale) > 0 {
+		for name, fam := range nameToFam {
+			if factor, ok := opts.scale[name]; ok {
+				scaleFamily(fam, factor)
+			}
+		}
+	}
+	if opts.prefix != "" {
+		// The parser has already dealt with suffixes like _sum and _count, so
+		// it's safe to simply prepend the prefix to the family name.
+		prefixed := make(map[string]*dto.MetricFamily, len(nameToFam))
+		for name, fam := range nameToFam {
+			fam.Name = proto.String(opts.prefix + name)
+			prefixed[fam.GetName()] = fam
+		}
+		nameToFam = prefixed
+	}
+	if len(opts.labels) > 0 {
+		for name, fam := range nameToFam {
+			for _, m := range fam.Metric {
+				var err error
+				if m.Label, err = addLabelPairs(m.Label, opts); err != nil {
+					return nil, stats, fmt.Errorf("metric %s: %v", name, err)
+				}
+			}
+		}
+	}
+	return regatherer(nameToFam), stats, nil
+}
+
+// scaleFamily multiplies the values of the samples in fam by factor.  Counts
+// of observations aren't values, so aren't scaled.
+func scaleFamily(fam *dto.MetricFamily, factor float64) {
+	scale := func(v *float64) {
+		if v != nil {
+			*v *= factor
+		}
+	}
+	for _, m := range fam.Metric {
+		if m.Gauge != nil {
+			scale(m.Gauge.Value)
+		}
+		if m.Counter != nil {
+			scale(m.Counter.Value)
+		}
+		if m.Untyped != nil {
+			scale(m.Untyped.Value)
+		}
+		if m.Summary != nil {
+			scale(m.Summary.SampleSum)
+			for _, q := range m.Summary.Quantile {
+				scale(q.Value)
+			}
+		}
+		if m.Histogram != nil {
+			scale(m.Histogram.SampleSum)
+			for _, b := range m.Histogram.Bucket {
+				scale(b.UpperBound)
+			}
+		}
+	}
+}
+
+// addLabelPairs returns pairs with opts.labels added.
+func addLabelPairs(pairs []*dto.LabelPair, opts parseOpts) ([]*dto.LabelPair, error) {
+	seen := make(map[string]bool, len(opts.labels))
+	for _, lp := range pairs {
+		v, ok := opts.labels[lp.GetName()]
+		if !ok {
+			continue
+		}
+		if opts.labelsError {
+			return nil, fmt.Errorf("label %s conflicts with a configured label", lp.GetName())
+		}
+		lp.Value = proto.String(v)
+		seen[lp.GetName()] = true
+	}
+	for k, v := range opts.labels {
+		if !seen[k] {
+			pairs = append(pairs, &dto.LabelPair{Name: proto.String(k), Value: proto.String(v)})
+		}
+	}
+	return pairs, nil
+}
+
+// addLabels adds opts.labels to labels, which belong to metric.
+func addLabels(labels map[string]string, metric string, opts parseOpts) error {
+	for k, v := range opts.labels {
+		if _, ok := labels[k]; ok && opts.labelsError {
+			return fmt.Errorf("tag %s of metric %s conflicts with a configured label", k, metric)
+		}
+		labels[k] = v
+	}
+	return nil
+}
+
+// parseMergingFamilies parses text in the Prometheus text format, allowing
+// the same metric family to be declared by HELP and TYPE lines more than
+// once, as happens when the output of several commands is concatenated.  The
+// metrics of each declaration are merged into a single family; where the same
+// labels appear twice, the later sample wins.  Declarations of a family with
+// different types are an error.
+func parseMergingFamilies(text string) (map[string]*dto.MetricFamily, error) {
+	// The parser only objects to a family being declared twice, so parse
+	// each declaration and the samples following it separately.
+	var chunks []string
+	var chunk bytes.Buffer
+	declaring := ""
+	for _, line := range strings.SplitAfter(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "#" && (fields[1] == "HELP" || fields[1] == "TYPE") {
+			if fields[2] != declaring && chunk.Len() > 0 {
+				chunks = append(chunks, chunk.String())
+				chunk.Reset()
+			}
+			declaring = fields[2]
+		} else if len(fields) > 0 && !strings.HasPrefix(fields[0], "#") {
+			declaring = ""
+		}
+		chunk.WriteString(line)
+	}
+	chunks = append(chunks, chunk.String())
+
+	merged := make(map[string]*dto.MetricFamily)
+	for _, chunk := range chunks {
+		tp := &expfmt.TextParser{}
+		nameToFam, err := tp.TextToMetricFamilies(strings.NewReader(chunk))
 		if err != nil {
-			return fmt.Errorf("Error parsing Prometheus TextFormat: %v", err)
+			return nil, err
 		}
-		gatherers = append(gatherers, regatherer(nameToFam))
+		for name, fam := range nameToFam {
+			into, ok := merged[name]
+			if !ok {
+				merged[name] = fam
+				continue
+			}
+			if into.GetType() != fam.GetType() {
+				return nil, fmt.Errorf("metric family %s declared with types %s and %s", name, into.GetType(), fam.GetType())
+			}
+			if into.Help == nil {
+				into.Help = fam.Help
+			}
+			into.Metric = append(into.Metric, fam.Metric...)
+		}
+	}
+	for _, fam := range merged {
+		fam.Metric = dedupMetrics(fam.Metric)
 	}
+	return merged, nil
+}
 
-	handler := promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{})
-	handler.ServeHTTP(w, r)
+// dedupMetrics returns metrics with only the last of those having the same
+// labels kept.
+func dedupMetrics(metrics []*dto.Metric) []*dto.Metric {
+	last := make(map[string]int, len(metrics))
+	keys := make([]string, len(metrics))
+	for i, m := range metrics {
+		keys[i] = labelsKey(m)
+		last[keys[i]] = i
+	}
+	if len(last) == len(metrics) {
+		return metrics
+	}
+	result := make([]*dto.Metric, 0, len(last))
+	for i, m := range metrics {
+		if last[keys[i]] == i {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// labelsKey returns a string identifying the labels of m, whatever their
+// order.
+func labelsKey(m *dto.Metric) string {
+	pairs := make([]string, 0, len(m.Label))
+	for _, lp := range m.Label {
+		pairs = append(pairs, lp.GetName()+"\xff"+lp.GetValue())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xfe")
+}
+
+// gathererFromRuns is like gathererFromText, but interprets the output of
+// several runs of a script, combining the values of each timeseries using
+// the aggregation function aggregate.
+func gathererFromRuns(opts parseOpts, texts []string, aggregate string) (prometheus.Gatherer, parseStats, error) {
+	start := time.Now()
+	var stats parseStats
+	runs := make([][]*dto.MetricFamily, 0, len(texts))
+	for _, text := range texts {
+		text, err := prepareText(opts, text)
+		if err != nil {
+			return nil, parseStats{}, err
+		}
+		gatherer, runStats, err := parseText(opts, text)
+		if err != nil {
+			return nil, parseStats{}, err
+		}
+		fams, err := gatherer.Gather()
+		if err != nil {
+			return nil, parseStats{}, err
+		}
+		runs = append(runs, fams)
+		if stats.oldest.IsZero() || (!runStats.oldest.IsZero() && runStats.oldest.Before(stats.oldest)) {
+			stats.oldest = runStats.oldest
+		}
+		stats.skipped += runStats.skipped
+	}
+
+	var gatherer prometheus.Gatherer = regatherer(aggregateFamilies(runs, aggregate))
+	if len(opts.relabel) > 0 {
+		gatherer = relabelGatherer{gatherer, opts.relabel}
+	}
+	var err error
+	stats.timeseries, stats.names, err = countTimeseries(gatherer)
+	if err != nil {
+		return nil, parseStats{}, err
+	}
+	stats.duration = time.Since(start)
+	return gatherer, stats, nil
+}
+
+// aggregateFamilies combines the metric families gathered from several runs
+// of a script, returning a family for each name seen in any run.  The value
+// of each gauge, counter and untyped timeseries is the result of applying
+// aggregate to its values in the runs it appears in; any other timeseries is
+// taken from the last run it appears in.
+func aggregateFamilies(runs [][]*dto.MetricFamily, aggregate string) map[string]*dto.MetricFamily {
+	result := make(map[string]*dto.MetricFamily)
+	values := make(map[string]map[string][]float64)
+	latest := make(map[string]map[string]*dto.Metric)
+	type series struct{ name, key string }
+	var order []series
+	for _, fams := range runs {
+		for _, fam := range fams {
+			name := fam.GetName()
+			if _, ok := result[name]; !ok {
+				result[name] = &dto.MetricFamily{Name: fam.Name, Help: fam.Help, Type: fam.Type}
+				values[name] = make(map[string][]float64)
+				latest[name] = make(map[string]*dto.Metric)
+			}
+			for _, m := range fam.Metric {
+				key := labelsKey(m)
+				if _, ok := latest[name][key]; !ok {
+					order = append(order, series{name, key})
+				}
+				latest[name][key] = m
+				if v := scalarValue(fam.GetType(), m); v != nil {
+					values[name][key] = append(values[name][key], *v)
+				}
+			}
+		}
+	}
+
+	for _, s := range order {
+		m := latest[s.name][s.key]
+		if v := scalarValue(result[s.name].GetType(), m); v != nil {
+			*v = aggregateValues(values[s.name][s.key], aggregate)
+		}
+		result[s.name].Metric = append(result[s.name].Metric, m)
+	}
+	return result
+}
+
+// scalarValue returns a pointer to the value of m, which belongs to a family
+// of type t, or nil if t isn't a gauge, counter or untyped.
+func scalarValue(t dto.MetricType, m *dto.Metric) *float64 {
+	switch {
+	case t == dto.MetricType_GAUGE && m.Gauge != nil:
+		return m.Gauge.Value
+	case t == dto.MetricType_COUNTER && m.Counter != nil:
+		return m.Counter.Value
+	case t == dto.MetricType_UNTYPED && m.Untyped != nil:
+		return m.Untyped.Value
+	}
 	return nil
 }
 
+// aggregateValues returns the result of applying aggregate to values, which
+// mustn't be empty.
+func aggregateValues(values []float64, aggregate string) float64 {
+	result := values[0]
+	for _, v := range values[1:] {
+		switch aggregate {
+		case aggregateMin:
+			result = math.Min(result, v)
+		case aggregateMax:
+			result = math.Max(result, v)
+		default:
+			result += v
+		}
+	}
+	if aggregate == aggregateAvg || aggregate == "" {
+		result /= float64(len(values))
+	}
+	return result
+}
+
+// opentsdbTime converts an OpenTSDB timestamp, which may be in seconds or
+// milliseconds since the epoch, to a Time.
+func opentsdbTime(ts int64) time.Time {
+	// Timestamps in seconds won't reach this until the year 33658.
+	if ts >= 1e12 {
+		return time.Unix(0, ts*int64(time.Millisecond))
+	}
+	return time.Unix(ts, 0)
+}
+
 // regatherer is used to take the output from expfmt.TextParser
 // and make it gatherable so that promhttp.HandlerFor can digest it.
 type regatherer map[string]*dto.MetricFamily
 
-// Gather implements Gatherer.
+// Gather implements Gatherer.  Families are returned sorted by name, so the
+// output is the same however the map is iterated.
 func (r regatherer) Gather() ([]*dto.MetricFamily, error) {
 	fams := make([]*dto.MetricFamily, 0, len(r))
 	for _, fam := range r {
@@ -57,9 +614,49 @@ func (r regatherer) Gather() ([]*dto.MetricFamily, error) {
 		}
 		fams = append(fams, fam)
 	}
+	sort.Slice(fams, func(i, j int) bool { return fams[i].GetName() < fams[j].GetName() })
 	return fams, nil
 }
 
+// labelGatherer wraps a Gatherer, adding a label with a fixed value to every
+// metric it yields.  If the metric already has a label by that name, its
+// value is replaced.
+type labelGatherer struct {
+	prometheus.Gatherer
+	name, value string
+}
+
+// Gather implements Gatherer.
+func (lg labelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	fams, err := lg.Gatherer.Gather()
+	for _, fam := range fams {
+		for _, m := range fam.Metric {
+			found := false
+			for _, lp := range m.Label {
+				if lp.GetName() == lg.name {
+					lp.Value = proto.String(lg.value)
+					found = true
+				}
+			}
+			if !found {
+				m.Label = append(m.Label, &dto.LabelPair{
+					Name:  proto.String(lg.name),
+					Value: proto.String(lg.value),
+				})
+				sort.Sort(prometheus.LabelPairSorter(m.Label))
+			}
+		}
+	}
+	return fams, err
+}
+
+// constGatherer returns a Gatherer yielding metrics.
+func constGatherer(metrics ...prometheus.Metric) prometheus.Gatherer {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(&sliceCollector{metrics})
+	return reg
+}
+
 // sliceCollector is a prometheus.Collector based on a slice of metrics.
 type sliceCollector struct {
 	metrics []prometheus.Metric
@@ -81,27 +678,101 @@ func (sc *sliceCollector) Describe(ch chan<- *prometheus.Desc) {
 
 // translateOpenTsdb takes a string containing OpenTSDB metrics
 // and translates it into Prometheus metrics.
-func translateOpenTsdb(input string) ([]prometheus.Metric, error) {
+func translateOpenTsdb(input string, opts parseOpts) ([]prometheus.Metric, error) {
+	dpoints, meta, err := parseOpenTsdb(input)
+	if err != nil {
+		return []prometheus.Metric{}, err
+	}
+	return dpointsToMetrics(dpoints, meta, opts)
+}
+
+// parseOpenTsdb parses a string containing OpenTSDB metrics into data
+// points, and what HELP and TYPE comments declare about them.
+func parseOpenTsdb(input string) ([]opentsdb.DataPoint, map[string]opentsdbMeta, error) {
 	scanner := bufio.NewScanner(strings.NewReader(input))
 	var dpoints []opentsdb.DataPoint
+	meta := make(map[string]opentsdbMeta)
 	for scanner.Scan() {
-		line := scanner.Text()
+		line := strings.TrimSuffix(scanner.Text(), "\r")
 		if strings.TrimSpace(line) == "" {
 			continue
 		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			if err := parseOpenTsdbComment(line, meta); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
 		dpoint, err := parseTcollectorValue(line)
 		if err != nil {
-			return []prometheus.Metric{}, err
+			return nil, nil, err
 		}
 		dpoints = append(dpoints, *dpoint)
 	}
 
-	err := scanner.Err()
-	if err != nil {
-		return []prometheus.Metric{}, err
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
 	}
+	return dpoints, meta, nil
+}
 
-	return dpointsToMetrics(dpoints)
+// opentsdbMeta holds the help text and type declared for a metric by
+// # HELP and # TYPE comments in OpenTSDB input.
+type opentsdbMeta struct {
+	help      string
+	valueType prometheus.ValueType
+}
+
+// parseOpenTsdbComment interprets a comment line in OpenTSDB input.  If it's
+// a HELP or TYPE directive in the style of the Prometheus text format, meta
+// is updated with what it declares for the metric it names.  Any other
+// comment is ignored.
+func parseOpenTsdbComment(line string, meta map[string]opentsdbMeta) error {
+	fields := strings.Fields(strings.TrimPrefix(strings.TrimSpace(line), "#"))
+	if len(fields) < 2 || (fields[0] != "HELP" && fields[0] != "TYPE") {
+		return nil
+	}
+
+	name := makeValidPromName(fields[1])
+	m := meta[name]
+	if fields[0] == "HELP" {
+		m.help = strings.Join(fields[2:], " ")
+	} else {
+		if len(fields) != 3 {
+			return fmt.Errorf("bad TYPE line: %s", line)
+		}
+		valueType, err := parseOpenTsdbType(fields[2])
+		if err != nil {
+			return fmt.Errorf("unsupported type for metric %s: %s", fields[1], fields[2])
+		}
+		m.valueType = valueType
+	}
+	meta[name] = m
+	return nil
+}
+
+// typeTag is the OpenTSDB tag which may be used to give the type of a
+// single data point, as an alternative to a TYPE comment.  It isn't
+// emitted as a label.
+const typeTag = "__type__"
+
+// helpTag is the OpenTSDB tag which may be used to give the help text of a
+// metric, as an alternative to a HELP comment.  Its value may be quoted, e.g.
+// __help__="Disk usage in bytes".  It isn't emitted as a label.
+const helpTag = "__help__"
+
+// parseOpenTsdbType returns the value type named s, one of counter, gauge,
+// or untyped.
+func parseOpenTsdbType(s string) (prometheus.ValueType, error) {
+	switch s {
+	case "counter":
+		return prometheus.CounterValue, nil
+	case "gauge":
+		return prometheus.GaugeValue, nil
+	case "untyped":
+		return prometheus.UntypedValue, nil
+	}
+	return 0, fmt.Errorf("unsupported type '%s'", s)
 }
 
 // makeValidPromName translates OpenTSDB metric names to Prometheus metric
@@ -123,15 +794,53 @@ func makeValidPromName(s string) string {
 		s)
 }
 
-// dpoints translates OpenTSDB samples into Prometheus format.
-func dpointsToMetrics(dpoints []opentsdb.DataPoint) ([]prometheus.Metric, error) {
-	var metrics []prometheus.Metric
+// dpoints translates OpenTSDB samples into Prometheus format.  Metrics are
+// gauges unless meta or a __type__ tag declares otherwise.  Names are left
+// alone whatever the type, so counters should already end in _total.
+func dpointsToMetrics(dpoints []opentsdb.DataPoint, meta map[string]opentsdbMeta, opts parseOpts) ([]prometheus.Metric, error) {
+	var samples []tsdbSample
+
+	// A help tag on any data point applies to all of the metric's.
+	tagHelps := make(map[string]string)
+	for _, dpoint := range dpoints {
+		tagHelp, ok := dpoint.Tags[helpTag]
+		if !ok {
+			continue
+		}
+		name := makeValidPromName(dpoint.Metric)
+		if m, ok := meta[name]; ok && m.help != "" && m.help != tagHelp {
+			return nil, fmt.Errorf("%s tag for metric %s conflicts with its HELP comment", helpTag, dpoint.Metric)
+		}
+		if h, ok := tagHelps[name]; ok && h != tagHelp {
+			return nil, fmt.Errorf("%s tag for metric %s conflicts with an earlier one", helpTag, dpoint.Metric)
+		}
+		tagHelps[name] = tagHelp
+	}
 
 	for _, dpoint := range dpoints {
+		var tagType prometheus.ValueType
 		labels := make(map[string]string, len(dpoint.Tags))
 		for k, v := range dpoint.Tags {
+			if k == helpTag {
+				continue
+			}
+			if k == typeTag {
+				t, err := parseOpenTsdbType(v)
+				if err != nil {
+					return nil, fmt.Errorf("bad %s tag for metric %s: %v", typeTag, dpoint.Metric, err)
+				}
+				tagType = t
+				continue
+			}
+			v, err := opts.labelValues.sanitize(v)
+			if err != nil {
+				return nil, fmt.Errorf("bad value for tag %s of metric %s: %v", k, dpoint.Metric, err)
+			}
 			labels[makeValidPromName(k)] = v
 		}
+		if err := addLabels(labels, dpoint.Metric, opts); err != nil {
+			return nil, err
+		}
 
 		var v float64
 		switch x := dpoint.Value.(type) {
@@ -145,20 +854,215 @@ func dpointsToMetrics(dpoints []opentsdb.DataPoint) ([]prometheus.Metric, error)
 			v = float64(x)
 		}
 
-		// Although we read the timestamp into the DataPoint, I don't see a way
-		// to populate the corresonding Prometheus metric with it.  That's okay for
-		// this project's purpose.
+		name := makeValidPromName(dpoint.Metric)
+		help, valueType := "help", prometheus.GaugeValue
+		if factor, ok := opts.scale[name]; ok {
+			v *= factor
+		}
+		if m, ok := meta[name]; ok {
+			if m.help != "" {
+				help = m.help
+			}
+			if m.valueType != 0 {
+				valueType = m.valueType
+			}
+		}
+		if h, ok := tagHelps[name]; ok {
+			help = h
+		}
+		typed := tagType != 0 || meta[name].valueType != 0
+		if tagType != 0 {
+			if m, ok := meta[name]; ok && m.valueType != 0 && m.valueType != tagType {
+				return nil, fmt.Errorf("%s tag for metric %s conflicts with its TYPE comment", typeTag, dpoint.Metric)
+			}
+			valueType = tagType
+		}
+		samples = append(samples, tsdbSample{name: name, help: help, labels: labels, valueType: valueType, typed: typed, value: v})
+	}
+
+	var metrics []prometheus.Metric
+	if opts.quantiles {
+		helpFor := func(name string) string {
+			if h, ok := tagHelps[name]; ok {
+				return h
+			}
+			if m := meta[name]; m.help != "" {
+				return m.help
+			}
+			return "help"
+		}
+		var err error
+		metrics, samples, err = summarizeQuantiles(samples, opts, helpFor)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Although we read the timestamp into the DataPoint, I don't see a way
+	// to populate the corresonding Prometheus metric with it.  That's okay for
+	// this project's purpose.
+	for _, s := range samples {
 		metrics = append(metrics, prometheus.MustNewConstMetric(
-			prometheus.NewDesc(makeValidPromName(dpoint.Metric), "help", []string{}, labels),
-			prometheus.GaugeValue, v))
+			prometheus.NewDesc(opts.prefix+s.name, s.help, []string{}, s.labels),
+			s.valueType, s.value))
 	}
 	return metrics, nil
 }
 
+// A tsdbSample is an OpenTSDB data point converted to a Prometheus sample.
+// typed is true if its type was given by a TYPE comment or type tag.
+type tsdbSample struct {
+	name, help string
+	labels     map[string]string
+	valueType  prometheus.ValueType
+	typed      bool
+	value      float64
+}
+
+// quantileSuffix matches the suffix of metric names like latency_p99 giving
+// a percentile.
+var quantileSuffix = regexp.MustCompile(`^(.+)_p([0-9]+)$`)
+
+// quantileName splits name, if it ends in a percentile suffix like _p99, into
+// the name before the suffix and the quantile it gives.  Suffixes of one or
+// two digits give a percentile, so _p5 is the 0.05 quantile and _p99 the 0.99
+// quantile.  Longer ones give further digits of the quantile, so _p999 is the
+// 0.999 quantile, except that _p100 is the maximum.
+func quantileName(name string) (string, float64, bool) {
+	m := quantileSuffix.FindStringSubmatch(name)
+	if m == nil {
+		return "", 0, false
+	}
+	digits := m[2]
+	if digits == "100" {
+		return m[1], 1, true
+	}
+	if len(digits) <= 2 {
+		digits = strings.Repeat("0", 2-len(digits)) + digits
+	}
+	q, err := strconv.ParseFloat("0."+digits, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return m[1], q, true
+}
+
+// A quantileGroup collects the samples making up a summary.
+type quantileGroup struct {
+	name      string
+	labels    map[string]string
+	quantiles map[float64]float64
+	count     uint64
+	sum       float64
+}
+
+// summarizeQuantiles turns gauges whose names end in a percentile suffix,
+// e.g. latency_p50 and latency_p99, into summaries, such as latency with a
+// quantile label of 0.5 and 0.99.  Gauges with the summary's name suffixed
+// with _count and _sum and the same labels give the summary's count and sum,
+// which are otherwise 0.  It returns the summaries and the samples not
+// absorbed into them.  Samples with an explicit type or an existing quantile
+// label are left alone.  helpFor gives the help text of a summary by name.
+func summarizeQuantiles(samples []tsdbSample, opts parseOpts, helpFor func(string) string) ([]prometheus.Metric, []tsdbSample, error) {
+	groups := make(map[string]*quantileGroup)
+	var order []string
+	var rest []tsdbSample
+	for _, s := range samples {
+		base, q, ok := quantileName(s.name)
+		if _, reserved := s.labels["quantile"]; !ok || reserved || s.typed {
+			rest = append(rest, s)
+			continue
+		}
+		key := base + "\xfd" + labelsMapKey(s.labels)
+		g, ok := groups[key]
+		if !ok {
+			g = &quantileGroup{name: base, labels: s.labels, quantiles: make(map[float64]float64)}
+			groups[key] = g
+			order = append(order, key)
+		}
+		if _, dup := g.quantiles[q]; dup {
+			return nil, nil, fmt.Errorf("metric %s gives quantile %v of %s more than once", s.name, q, base)
+		}
+		g.quantiles[q] = s.value
+	}
+
+	var unabsorbed []tsdbSample
+	for _, s := range rest {
+		key := labelsMapKey(s.labels)
+		if g, ok := groups[strings.TrimSuffix(s.name, "_count")+"\xfd"+key]; ok && !s.typed && strings.HasSuffix(s.name, "_count") {
+			g.count = uint64(s.value)
+		} else if g, ok := groups[strings.TrimSuffix(s.name, "_sum")+"\xfd"+key]; ok && !s.typed && strings.HasSuffix(s.name, "_sum") {
+			g.sum = s.value
+		} else {
+			unabsorbed = append(unabsorbed, s)
+		}
+	}
+
+	var metrics []prometheus.Metric
+	for _, key := range order {
+		g := groups[key]
+		if factor, ok := opts.scale[g.name]; ok {
+			for q := range g.quantiles {
+				g.quantiles[q] *= factor
+			}
+			g.sum *= factor
+		}
+		m, err := prometheus.NewConstSummary(
+			prometheus.NewDesc(opts.prefix+g.name, helpFor(g.name), []string{}, g.labels),
+			g.count, g.sum, g.quantiles)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to make summary %s: %v", g.name, err)
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, unabsorbed, nil
+}
+
+// labelsMapKey returns a string identifying the set of labels.
+func labelsMapKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"\xff"+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xfe")
+}
+
+// splitUnquoted splits s around runs of characters satisfying isSep, except
+// within double-quoted strings, in which a backslash escapes the next
+// character.  Empty fields are omitted.
+func splitUnquoted(s string, isSep func(rune) bool) []string {
+	var fields []string
+	start, quoted, escaped := -1, false, false
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case !quoted && isSep(r):
+			if start >= 0 {
+				fields = append(fields, s[start:i])
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, s[start:])
+	}
+	return fields
+}
+
 // parseTcollectorValue parses a tcollector-style line into a data point.
 // This was lifted from scollector.
 func parseTcollectorValue(line string) (*opentsdb.DataPoint, error) {
-	sp := strings.Fields(line)
+	sp := splitUnquoted(line, unicode.IsSpace)
 	if len(sp) < 3 {
 		return nil, fmt.Errorf("bad line: %s", line)
 	}
@@ -178,13 +1082,28 @@ func parseTcollectorValue(line string) (*opentsdb.DataPoint, error) {
 		Timestamp: ts,
 		Value:     val,
 	}
+	// Unlike scollector we don't use opentsdb.ParseTags, which only accepts
+	// a restricted set of characters in tag values: it's up to
+	// dpointsToMetrics to decide what to do with unusual values.
 	tags := opentsdb.TagSet{}
 	for _, tag := range sp[3:] {
-		ts, err := opentsdb.ParseTags(tag)
-		if err != nil {
-			return nil, fmt.Errorf("bad tag, metric %s: %v: %v", sp[0], tag, err)
+		for _, kv := range splitUnquoted(tag, func(r rune) bool { return r == ',' }) {
+			kvs := strings.SplitN(kv, "=", 2)
+			if len(kvs) != 2 || kvs[0] == "" || kvs[1] == "" {
+				return nil, fmt.Errorf("bad tag, metric %s: %v", sp[0], kv)
+			}
+			if strings.HasPrefix(kvs[1], `"`) {
+				v, err := strconv.Unquote(kvs[1])
+				if err != nil {
+					return nil, fmt.Errorf("bad quoted tag value, metric %s: %v", sp[0], kv)
+				}
+				kvs[1] = v
+			}
+			if _, present := tags[kvs[0]]; present {
+				return nil, fmt.Errorf("duplicated tag, metric %s: %v", sp[0], kv)
+			}
+			tags[kvs[0]] = kvs[1]
 		}
-		tags.Merge(ts)
 	}
 	dp.Tags = tags
 	return &dp, nil
@@ -2,39 +2,195 @@ package main
 
 import (
 	// "github.com/kylelemons/godebug/pretty"
+	"bytes"
 	"context"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	. "gopkg.in/check.v1"
 )
 
 func (s MySuite) TestRunCommand(c *C) {
 	// Test zero exit code
-	out, err := runCommand(context.Background(), "true")
+	out, err := runCommand(context.Background(), commandOpts{}, "true")
 	c.Assert(err, IsNil)
 	c.Check(out, Equals, "")
 
 	// Test nonzero exit code
-	out, err = runCommand(context.Background(), "false")
+	out, err = runCommand(context.Background(), commandOpts{}, "false")
 	c.Assert(err, Not(IsNil))
 	c.Check(out, Equals, "")
 
 	// Test stdout capture
-	out, err = runCommand(context.Background(), "echo", "test")
+	out, err = runCommand(context.Background(), commandOpts{}, "echo", "test")
 	c.Assert(err, IsNil)
 	c.Check(out, Equals, "test\n")
 
 	// Test stderr causes failure
-	out, err = runCommand(context.Background(), "sh", "-c", "echo err 1>&2")
+	out, err = runCommand(context.Background(), commandOpts{}, "sh", "-c", "echo err 1>&2")
 	c.Assert(err, Not(IsNil))
 }
 
+func (s MySuite) TestRunCommandCopyGoroutines(c *C) {
+	count := func(counter prometheus.Counter) float64 {
+		var m dto.Metric
+		c.Assert(counter.Write(&m), IsNil)
+		return m.GetCounter().GetValue()
+	}
+	started, finished := count(mCopiesStarted), count(mCopiesFinished)
+
+	// Both the stdout and stderr goroutines are counted out again, whether
+	// the command exits or times out.
+	_, err := runCommand(context.Background(), commandOpts{}, "echo", "test")
+	c.Assert(err, IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = runCommand(ctx, commandOpts{}, "sleep", "5")
+	c.Assert(err, Equals, timeoutError{})
+
+	// Other tests' scripts may still be running in the background, so only
+	// lower bounds can be checked.
+	c.Check(count(mCopiesStarted)-started >= 4, Equals, true)
+	c.Check(count(mCopiesFinished)-finished >= 4, Equals, true)
+}
+
+func (s MySuite) TestRunCommandErrorTypes(c *C) {
+	run := func(ctx context.Context, opts commandOpts, script string) error {
+		_, err := runCommand(ctx, opts, "sh", "-c", script)
+		return err
+	}
+	bg := context.Background()
+	c.Check(run(bg, commandOpts{}, "exit 0"), IsNil)
+	c.Check(run(bg, commandOpts{}, "exit 2"), FitsTypeOf, exitError{})
+	c.Check(run(bg, commandOpts{}, "kill -9 $$"), FitsTypeOf, exitError{})
+	c.Check(run(bg, commandOpts{successCodes: []int{2}}, "exit 2"), IsNil)
+	c.Check(run(bg, commandOpts{}, "echo err 1>&2"), FitsTypeOf, stderrError{})
+	_, err := runCommand(bg, commandOpts{}, "/nonexistent")
+	c.Check(err, FitsTypeOf, spawnError{})
+
+	ctx, cancel := context.WithTimeout(bg, 100*time.Millisecond)
+	defer cancel()
+	c.Check(run(ctx, commandOpts{}, "sleep 5"), Equals, timeoutError{})
+	ctx, cancel = context.WithCancel(bg)
+	time.AfterFunc(100*time.Millisecond, cancel)
+	c.Check(run(ctx, commandOpts{}, "sleep 5"), Equals, context.Canceled)
+}
+
+func (s MySuite) TestRunCommandSpawnError(c *C) {
+	dir, err := ioutil.TempDir("", "script-exporter")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	noexec := path.Join(dir, "noexec")
+	c.Assert(ioutil.WriteFile(noexec, []byte("#!/bin/sh\n"), 0644), IsNil)
+
+	for _, script := range []string{path.Join(dir, "missing"), noexec} {
+		_, err = runCommand(context.Background(), commandOpts{}, script)
+		c.Check(err, FitsTypeOf, spawnError{}, Commentf("%s", script))
+	}
+
+	// A script that starts but fails isn't a spawn error.
+	_, err = runCommand(context.Background(), commandOpts{}, "false")
+	c.Check(err, FitsTypeOf, exitError{})
+}
+
+func (s MySuite) TestRunCommandStderr(c *C) {
+	var stderr bytes.Buffer
+	_, err := runCommand(context.Background(), commandOpts{stderr: &stderr}, "sh", "-c", "echo err 1>&2; exit 3")
+	c.Assert(err, Not(IsNil))
+	c.Check(exitCode(err), Equals, 3)
+	c.Check(stderr.String(), Equals, "err\n")
+
+	_, err = runCommand(context.Background(), commandOpts{}, "sh", "-c", "echo err 1>&2")
+	c.Assert(err, Not(IsNil))
+	c.Check(exitCode(err), Equals, 0)
+
+	_, err = runCommand(context.Background(), commandOpts{}, "/nonexistent")
+	c.Assert(err, Not(IsNil))
+	c.Check(exitCode(err), Equals, -1)
+}
+
+func (s MySuite) TestRunCommandSuccessCodes(c *C) {
+	opts := commandOpts{successCodes: []int{1, 3}}
+	out, err := runCommand(context.Background(), opts, "sh", "-c", "echo a 1; exit 1")
+	c.Assert(err, IsNil)
+	c.Check(out, Equals, "a 1\n")
+
+	_, err = runCommand(context.Background(), opts, "sh", "-c", "exit 3")
+	c.Check(err, IsNil)
+
+	_, err = runCommand(context.Background(), opts, "sh", "-c", "exit 2")
+	c.Assert(err, Not(IsNil))
+	c.Check(exitCode(err), Equals, 2)
+
+	// Writing to stderr is still an error.
+	_, err = runCommand(context.Background(), opts, "sh", "-c", "echo err 1>&2; exit 1")
+	c.Assert(err, Not(IsNil))
+	c.Check(exitCode(err), Equals, 0)
+}
+
+func (s MySuite) TestRunCommandStderrLines(c *C) {
+	var lines []string
+	opts := commandOpts{
+		allowStderr: true,
+		stderrLine:  func(line string) { lines = append(lines, line) },
+	}
+	out, err := runCommand(context.Background(), opts, "sh", "-c", "echo one >&2; echo a 1; printf 'two\\nthree' >&2")
+	c.Assert(err, IsNil)
+	c.Check(out, Equals, "a 1\n")
+	c.Check(lines, DeepEquals, []string{"one", "two", "three"})
+}
+
+func (s MySuite) TestRunCommandStdin(c *C) {
+	out, err := runCommand(context.Background(), commandOpts{stdin: strings.NewReader("a 1\nb 2\n")}, "grep", "b")
+	c.Assert(err, IsNil)
+	c.Check(out, Equals, "b 2\n")
+}
+
+func (s MySuite) TestRunCommandTimeoutEnv(c *C) {
+	out, err := runCommand(context.Background(), commandOpts{}, "sh", "-c", "echo \"$SCRIPT_TIMEOUT_SECONDS\"")
+	c.Assert(err, IsNil)
+	c.Check(out, Equals, "\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err = runCommand(ctx, commandOpts{}, "sh", "-c", "echo \"$SCRIPT_TIMEOUT_SECONDS\"")
+	c.Assert(err, IsNil)
+	remaining, err := strconv.ParseFloat(strings.TrimSpace(out), 64)
+	c.Assert(err, IsNil)
+	c.Check(remaining > 9 && remaining <= 10, Equals, true, Commentf("remaining %v", remaining))
+}
+
+func (s MySuite) TestRunCommandDir(c *C) {
+	out, err := runCommand(context.Background(), commandOpts{dir: "/"}, "pwd")
+	c.Assert(err, IsNil)
+	c.Check(out, Equals, "/\n")
+
+	// Relative script paths are resolved against our working directory, not dir.
+	dir, err := ioutil.TempDir("", "script-exporter")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "script"), []byte("#!/bin/sh\npwd\n"), 0755), IsNil)
+	wd, err := os.Getwd()
+	c.Assert(err, IsNil)
+	rel, err := filepath.Rel(wd, path.Join(dir, "script"))
+	c.Assert(err, IsNil)
+	out, err = runCommand(context.Background(), commandOpts{dir: dir}, rel)
+	c.Assert(err, IsNil)
+	c.Check(out, Equals, dir+"\n")
+}
+
 func (s MySuite) TestRunCommandCancel(c *C) {
 	os.Remove("1")
 	os.Remove("2")
-	_, err := runCommand(context.Background(), "bash", "-c", "touch 1; sleep 5; touch 2")
+	_, err := runCommand(context.Background(), commandOpts{}, "bash", "-c", "touch 1; sleep 5; touch 2")
 	c.Assert(err, IsNil)
 	c.Assert(os.Remove("1"), IsNil)
 	c.Assert(os.Remove("2"), IsNil)
@@ -43,14 +199,51 @@ func (s MySuite) TestRunCommandCancel(c *C) {
 	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
 	defer cancel()
 	start := time.Now()
-	_, err = runCommand(ctx, "bash", "-c", "touch 1; sleep 5; touch 2")
+	_, err = runCommand(ctx, commandOpts{}, "bash", "-c", "touch 1; sleep 5; touch 2")
 	elapsed := time.Since(start)
-	c.Check(err, Equals, context.DeadlineExceeded)
+	c.Check(err, Equals, timeoutError{})
 	c.Check(os.Remove("1"), IsNil)
 	c.Check(os.Remove("2"), Not(IsNil))
 	c.Check(elapsed > time.Second, Equals, false)
 }
 
+func (s MySuite) TestRunCommandKillGracePeriod(c *C) {
+	os.Remove("1")
+	os.Remove("2")
+	// On timeout the script gets SIGTERM first, giving its trap a chance to run.
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := runCommand(ctx, commandOpts{killGracePeriod: 2 * time.Second}, "bash", "-c", "trap 'touch 2; exit 1' TERM; touch 1; sleep 5 & wait")
+	elapsed := time.Since(start)
+	c.Check(err, Equals, timeoutError{})
+	c.Check(os.Remove("1"), IsNil)
+	c.Check(os.Remove("2"), IsNil)
+	c.Check(elapsed < 2*time.Second, Equals, true)
+
+	// A script ignoring SIGTERM gets SIGKILL once the grace period elapses.
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = runCommand(ctx, commandOpts{killGracePeriod: time.Second}, "bash", "-c", "trap '' TERM; touch 1; sleep 5; touch 2")
+	elapsed = time.Since(start)
+	c.Check(err, Equals, timeoutError{})
+	c.Check(os.Remove("1"), IsNil)
+	c.Check(os.Remove("2"), Not(IsNil))
+	c.Check(elapsed >= 1500*time.Millisecond, Equals, true)
+	c.Check(elapsed < 3*time.Second, Equals, true)
+
+	// A hard timeout counts from when the script started, not from SIGTERM.
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = runCommand(ctx, commandOpts{killGracePeriod: 5 * time.Second, hardTimeout: time.Second}, "bash", "-c", "trap '' TERM; sleep 5")
+	elapsed = time.Since(start)
+	c.Check(err, Equals, timeoutError{})
+	c.Check(elapsed >= time.Second, Equals, true)
+	c.Check(elapsed < 1500*time.Millisecond, Equals, true)
+}
+
 // This method serves to document why runCommand is as big and ugly as it is.
 func (s MySuite) TestRunCommandUnsafeCancel(c *C) {
 	// Test we can timeout a shell script containing a sleep.  With runCommandUnsafe
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"bosun.org/opentsdb"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// An ndjsonSample is a line of NDJSON script output, giving one sample.
+// Type is one of counter, gauge (the default) or untyped.
+type ndjsonSample struct {
+	Name   string            `json:"name"`
+	Value  *float64          `json:"value"`
+	Labels map[string]string `json:"labels"`
+	Type   string            `json:"type"`
+}
+
+// parseNDJSON interprets text as newline-delimited JSON, each nonblank line
+// an ndjsonSample.  Samples are converted to metrics as OpenTSDB data points
+// are, so names and labels are sanitized the same way.  A line that can't be
+// converted, or that repeats an earlier timeseries or gives a metric a
+// different type than an earlier line, is skipped rather than failing the
+// whole output; the number skipped is returned.  It's an error if every line
+// is skipped.
+func parseNDJSON(opts parseOpts, text string) (prometheus.Gatherer, int, error) {
+	// Lines are converted one at a time, so can't be grouped into summaries.
+	opts.quantiles = false
+	var metrics []prometheus.Metric
+	types := make(map[string]prometheus.ValueType)
+	seen := make(map[string]bool)
+	skipped := 0
+	var lastErr error
+	for i, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		metric, key, err := ndjsonMetric(opts, line, types)
+		if err == nil && seen[key] {
+			err = fmt.Errorf("duplicate timeseries")
+		}
+		if err != nil {
+			skipped++
+			lastErr = fmt.Errorf("line %d: %v", i+1, err)
+			continue
+		}
+		seen[key] = true
+		metrics = append(metrics, metric)
+	}
+	if len(metrics) == 0 && lastErr != nil {
+		return nil, skipped, fmt.Errorf("Error parsing NDJSON: no line could be parsed, last error: %v", lastErr)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.Register(&sliceCollector{metrics})
+	return reg, skipped, nil
+}
+
+// ndjsonMetric converts line, a line of NDJSON output, to a metric.  It also
+// returns a key identifying its timeseries.  types records the type of each
+// metric name seen so far, and is updated.
+func ndjsonMetric(opts parseOpts, line string, types map[string]prometheus.ValueType) (prometheus.Metric, string, error) {
+	var s ndjsonSample
+	if err := json.Unmarshal([]byte(line), &s); err != nil {
+		return nil, "", err
+	}
+	if s.Name == "" {
+		return nil, "", fmt.Errorf("missing name")
+	}
+	if s.Value == nil {
+		return nil, "", fmt.Errorf("missing value for metric %s", s.Name)
+	}
+
+	valueType := prometheus.GaugeValue
+	if s.Type != "" {
+		t, err := parseOpenTsdbType(s.Type)
+		if err != nil {
+			return nil, "", fmt.Errorf("bad type for metric %s: %v", s.Name, err)
+		}
+		valueType = t
+	}
+	name := makeValidPromName(s.Name)
+	if t, ok := types[name]; ok && t != valueType {
+		return nil, "", fmt.Errorf("type of metric %s conflicts with an earlier line", s.Name)
+	}
+
+	tags := make(opentsdb.TagSet, len(s.Labels)+1)
+	for k, v := range s.Labels {
+		if k == typeTag {
+			return nil, "", fmt.Errorf("label %s of metric %s is reserved", typeTag, s.Name)
+		}
+		tags[k] = v
+	}
+	if s.Type != "" {
+		tags[typeTag] = s.Type
+	}
+	metrics, err := dpointsToMetrics([]opentsdb.DataPoint{{Metric: s.Name, Value: *s.Value, Tags: tags}}, nil, opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var m dto.Metric
+	if err := metrics[0].Write(&m); err != nil {
+		return nil, "", err
+	}
+	types[name] = valueType
+	return metrics[0], name + "\xfd" + labelsKey(&m), nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Arguments to ioprio_set(2), from linux/ioprio.h.
+const (
+	ioprioWhoPgrp    = 2
+	ioprioClassShift = 13
+)
+
+// ioClasses maps the names accepted for ScriptConfig.IOClass to the
+// corresponding I/O scheduling classes.
+var ioClasses = map[string]int{
+	ioClassRealtime:   1,
+	ioClassBestEffort: 2,
+	ioClassIdle:       3,
+}
+
+// setPriority sets the CPU and I/O scheduling priority of the process group
+// pgid.  The niceness is left alone if nice is zero, and the I/O class if
+// ioClass is empty.
+func setPriority(pgid, nice int, ioClass string, ioPriority int) error {
+	if nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PGRP, pgid, nice); err != nil {
+			return fmt.Errorf("unable to set nice value %d: %v", nice, err)
+		}
+	}
+	if ioClass != "" {
+		class, ok := ioClasses[ioClass]
+		if !ok {
+			return fmt.Errorf("unknown I/O class '%s'", ioClass)
+		}
+		prio := class<<ioprioClassShift | ioPriority
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoPgrp, uintptr(pgid), uintptr(prio)); errno != 0 {
+			return fmt.Errorf("unable to set I/O class %s: %v", ioClass, errno)
+		}
+	}
+	return nil
+}
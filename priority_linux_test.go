@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s MySuite) TestRunCommandPriority(c *C) {
+	// The priority is set just after the script starts, so check it from a
+	// command the script runs later.
+	out, err := runCommand(context.Background(), commandOpts{nice: 5}, "sh", "-c", "sleep 0.2; nice")
+	c.Assert(err, IsNil)
+	c.Check(out, Equals, "5\n")
+
+	if _, err := exec.LookPath("ionice"); err != nil {
+		c.Skip("ionice not installed")
+	}
+	out, err = runCommand(context.Background(), commandOpts{ioClass: ioClassIdle}, "sh", "-c", "sleep 0.2; ionice")
+	c.Assert(err, IsNil)
+	c.Check(strings.TrimSpace(out), Equals, "idle")
+
+	out, err = runCommand(context.Background(), commandOpts{ioClass: ioClassBestEffort, ioPriority: 6}, "sh", "-c", "sleep 0.2; ionice")
+	c.Assert(err, IsNil)
+	c.Check(strings.TrimSpace(out), Equals, "best-effort: prio 6")
+}
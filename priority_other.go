@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+// setPriority fails if a niceness or I/O class is given, since changing them
+// is only supported on Linux.
+func setPriority(pgid, nice int, ioClass string, ioPriority int) error {
+	if nice == 0 && ioClass == "" {
+		return nil
+	}
+	return fmt.Errorf("setting script priority is only supported on linux")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// readiness records whether the exporter is ready to serve scrapes.  It
+// serves the readiness endpoint, responding 503 until ready.
+type readiness struct {
+	ready int32
+}
+
+// setReady marks the exporter as ready.
+func (rd *readiness) setReady() {
+	atomic.StoreInt32(&rd.ready, 1)
+}
+
+// isReady returns true once setReady has been called.
+func (rd *readiness) isReady() bool {
+	return atomic.LoadInt32(&rd.ready) == 1
+}
+
+// ServeHTTP implements http.Handler.
+func (rd *readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !rd.isReady() {
+		http.Error(w, "Not ready: waiting for scripts", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("Ready\n"))
+}
+
+// gate returns a handler which responds 503 to requests until the exporter
+// is ready, and passes them on to h thereafter.
+func (rd *readiness) gate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rd.isReady() {
+			http.Error(w, "Not ready: waiting for scripts", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// errFoundScript stops the walk in hasScripts once a script has been found.
+var errFoundScript = errors.New("found script")
+
+// hasScripts returns true if dir exists and contains at least one executable
+// file, possibly in a subdirectory.
+func hasScripts(dir string) bool {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0 {
+			return errFoundScript
+		}
+		return nil
+	})
+	return err == errFoundScript
+}
+
+// waitForScripts polls every interval until dir contains a script, then marks
+// rd as ready.  While waiting it logs every logInterval.
+func waitForScripts(rd *readiness, dir string, interval, logInterval time.Duration) {
+	start, lastLog := time.Now(), time.Now()
+	for !hasScripts(dir) {
+		if time.Since(lastLog) >= logInterval {
+			infof("Still waiting for scripts to appear in '%s' after %v", dir, time.Since(start).Round(time.Second))
+			lastLog = time.Now()
+		}
+		time.Sleep(interval)
+	}
+	infof("Found scripts in '%s', ready", dir)
+	rd.setReady()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s MySuite) TestWaitForScripts(c *C) {
+	dir, err := ioutil.TempDir("", "script-exporter")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	scripts := path.Join(dir, "scripts")
+
+	rd := &readiness{}
+	gated := rd.gate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	go waitForScripts(rd, scripts, 10*time.Millisecond, time.Minute)
+
+	w := httptest.NewRecorder()
+	rd.ServeHTTP(w, httptest.NewRequest("GET", "/-/ready", nil))
+	c.Check(w.Code, Equals, 503)
+	w = httptest.NewRecorder()
+	gated.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/a", nil))
+	c.Check(w.Code, Equals, 503)
+
+	// Neither a missing directory, an empty one, nor one containing only
+	// non-executable files has scripts.
+	c.Check(hasScripts(scripts), Equals, false)
+	c.Assert(os.MkdirAll(path.Join(scripts, "sub"), 0755), IsNil)
+	c.Check(hasScripts(scripts), Equals, false)
+	c.Assert(ioutil.WriteFile(path.Join(scripts, "README"), nil, 0644), IsNil)
+	c.Check(hasScripts(scripts), Equals, false)
+	c.Assert(ioutil.WriteFile(path.Join(scripts, "sub", "a"), []byte("#!/bin/sh\n"), 0755), IsNil)
+	c.Check(hasScripts(scripts), Equals, true)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !rd.isReady() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	w = httptest.NewRecorder()
+	rd.ServeHTTP(w, httptest.NewRequest("GET", "/-/ready", nil))
+	c.Check(w.Code, Equals, 200)
+	w = httptest.NewRecorder()
+	gated.ServeHTTP(w, httptest.NewRequest("GET", "/metrics/a", nil))
+	c.Check(w.Code, Equals, 200)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// A RelabelConfig is a rule for rewriting the metrics emitted by a script,
+// modelled on Prometheus' relabel_configs.  The metric name is available as
+// the label __name__.
+type RelabelConfig struct {
+	// SourceLabels are the labels whose values, joined by Separator, are
+	// matched against Regex.  Separator defaults to ";".
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    string   `yaml:"separator"`
+
+	// Regex is matched against the joined source label values by replace,
+	// keep and drop, and against label names by labeldrop.  It's anchored
+	// at both ends, and defaults to "(.*)".
+	Regex string `yaml:"regex"`
+
+	// For replace, TargetLabel is set to Replacement, after expanding
+	// references like $1 to submatches of Regex.  Replacement defaults to
+	// "$1".  If the result is empty, TargetLabel is removed.
+	TargetLabel string `yaml:"target_label"`
+	Replacement string `yaml:"replacement"`
+
+	// Action is one of replace (the default), keep, drop, or labeldrop.
+	Action string `yaml:"action"`
+
+	re *regexp.Regexp
+}
+
+// Relabeling actions.
+const (
+	relabelReplace   = "replace"
+	relabelKeep      = "keep"
+	relabelDrop      = "drop"
+	relabelLabelDrop = "labeldrop"
+)
+
+// compile fills in defaults and compiles rc's regex, returning an error if
+// rc is invalid.
+func (rc *RelabelConfig) compile() error {
+	if rc.Action == "" {
+		rc.Action = relabelReplace
+	}
+	if rc.Separator == "" {
+		rc.Separator = ";"
+	}
+	if rc.Regex == "" {
+		rc.Regex = "(.*)"
+	}
+	if rc.Replacement == "" {
+		rc.Replacement = "$1"
+	}
+	switch rc.Action {
+	case relabelReplace:
+		if rc.TargetLabel == "" {
+			return fmt.Errorf("relabel action replace requires target_label")
+		}
+	case relabelKeep, relabelDrop, relabelLabelDrop:
+	default:
+		return fmt.Errorf("unknown relabel action '%s'", rc.Action)
+	}
+	re, err := regexp.Compile("^(?:" + rc.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid relabel regex '%s': %v", rc.Regex, err)
+	}
+	rc.re = re
+	return nil
+}
+
+// relabel applies rules to labels in order, returning false if the metric
+// they belong to is to be dropped.  labels is modified in place.
+func relabel(labels map[string]string, rules []*RelabelConfig) bool {
+	for _, rc := range rules {
+		if rc.Action == relabelLabelDrop {
+			for name := range labels {
+				if name != "__name__" && rc.re.MatchString(name) {
+					delete(labels, name)
+				}
+			}
+			continue
+		}
+
+		values := make([]string, len(rc.SourceLabels))
+		for i, name := range rc.SourceLabels {
+			values[i] = labels[name]
+		}
+		value := strings.Join(values, rc.Separator)
+		match := rc.re.FindStringSubmatchIndex(value)
+
+		switch rc.Action {
+		case relabelKeep:
+			if match == nil {
+				return false
+			}
+		case relabelDrop:
+			if match != nil {
+				return false
+			}
+		case relabelReplace:
+			if match == nil {
+				continue
+			}
+			target := string(rc.re.ExpandString(nil, rc.Replacement, value, match))
+			if target == "" {
+				delete(labels, rc.TargetLabel)
+			} else {
+				labels[rc.TargetLabel] = target
+			}
+		}
+	}
+	return labels["__name__"] != ""
+}
+
+// relabelGatherer wraps a Gatherer, applying relabeling rules to the metrics
+// it yields.
+type relabelGatherer struct {
+	prometheus.Gatherer
+	rules []*RelabelConfig
+}
+
+// Gather implements Gatherer.  The wrapped Gatherer's metrics aren't
+// modified, so that relabeling is applied afresh each time.
+func (rg relabelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	fams, err := rg.Gatherer.Gather()
+
+	var result []*dto.MetricFamily
+	byName := make(map[string]*dto.MetricFamily)
+	for _, fam := range fams {
+		for _, m := range fam.Metric {
+			labels := map[string]string{"__name__": fam.GetName()}
+			for _, lp := range m.Label {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			if !relabel(labels, rg.rules) {
+				continue
+			}
+
+			name := labels["__name__"]
+			delete(labels, "__name__")
+			out, ok := byName[name]
+			if !ok {
+				out = &dto.MetricFamily{Name: proto.String(name), Help: fam.Help, Type: fam.Type}
+				byName[name] = out
+				result = append(result, out)
+			}
+
+			nm := *m
+			nm.Label = make([]*dto.LabelPair, 0, len(labels))
+			for ln, lv := range labels {
+				nm.Label = append(nm.Label, &dto.LabelPair{Name: proto.String(ln), Value: proto.String(lv)})
+			}
+			sort.Sort(prometheus.LabelPairSorter(nm.Label))
+			out.Metric = append(out.Metric, &nm)
+		}
+	}
+	return result, err
+}
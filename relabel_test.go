@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s MySuite) TestRelabel(c *C) {
+	rules := []*RelabelConfig{
+		// Rename a metric.
+		{SourceLabels: []string{"__name__"}, Regex: "old_(.*)", TargetLabel: "__name__", Replacement: "new_$1"},
+		// Derive a label from two others.
+		{SourceLabels: []string{"host", "port"}, Separator: ":", Regex: "(.+:.+)", TargetLabel: "instance"},
+		{Action: "labeldrop", Regex: "host|port"},
+		{Action: "drop", SourceLabels: []string{"__name__"}, Regex: "debug_.*"},
+		{Action: "keep", SourceLabels: []string{"env"}, Regex: "prod|"},
+	}
+	for _, rc := range rules {
+		c.Assert(rc.compile(), IsNil)
+	}
+
+	text := `# HELP old_a help for a
+# TYPE old_a gauge
+old_a{host="h",port="1"} 1
+debug_b 2
+c{env="prod"} 3
+c{env="dev"} 4
+`
+	for _, opentsdb := range []bool{false, true} {
+		input := text
+		if opentsdb {
+			input = "old.a 0 1 host=h port=1\ndebug.b 0 2\nc 0 3 env=prod\nc 0 4 env=dev\n"
+		}
+		w := httptest.NewRecorder()
+		stats, err := serveMetricsFromText(parseOpts{opentsdb: opentsdb, relabel: rules}, w, httptest.NewRequest("GET", "/", nil), input)
+		c.Assert(err, IsNil)
+		c.Check(stats.timeseries, Equals, 2)
+		body := w.Body.String()
+		c.Check(body, Matches, `(?s).*\nnew_a{instance="h:1"} 1\n.*`)
+		c.Check(body, Matches, `(?s).*\nc{env="prod"} 3\n.*`)
+		c.Check(body, Not(Matches), `(?s).*(debug_b|old_a|env="dev").*`)
+	}
+
+	for _, rc := range []*RelabelConfig{
+		{Action: "replace"},
+		{Action: "hashmod"},
+		{Action: "keep", Regex: "("},
+	} {
+		c.Check(rc.compile(), Not(IsNil))
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"runtime/debug"
+	"syscall"
+	"unsafe"
+)
+
+// rlimitsEnv is set, to the limits and the exec status file descriptor as
+// "memory,files,cpu,fd", in the environment of the exporter when it's run by
+// limitCommand to apply limits to a script.
+const rlimitsEnv = "SCRIPT_EXPORTER_RLIMITS"
+
+func init() {
+	if spec, ok := os.LookupEnv(rlimitsEnv); ok {
+		execLimited(spec)
+	}
+}
+
+// limitCommand arranges for cmd to run under limits.  There's no way to have
+// exec set resource limits, and setting them once the script has started
+// would let any children it spawns straight away escape them, so cmd instead
+// runs the exporter itself, which sets them and then execs the script in
+// place of itself.  If that exec fails, the error is written to a pipe which
+// is closed on a successful exec.  The function returned, nil if there are no
+// limits, must be called once cmd.Start returns, and returns that error, if
+// any.
+func limitCommand(cmd *exec.Cmd, limits rlimits) (func() error, error) {
+	if limits == (rlimits{}) {
+		return nil, nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("unable to find own executable to apply limits: %v", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create exec status pipe: %v", err)
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	fd := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d,%d,%d,%d", rlimitsEnv, limits.memory, limits.files, limits.cpuSeconds(), fd))
+	cmd.Args = append([]string{self, cmd.Path}, cmd.Args...)
+	cmd.Path = self
+	return func() error {
+		w.Close()
+		defer r.Close()
+		msg, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("unable to read exec status: %v", err)
+		}
+		if len(msg) > 0 {
+			return errors.New(string(msg))
+		}
+		return nil
+	}, nil
+}
+
+// execLimited runs in the exporter when started by limitCommand, with the
+// script's path in os.Args[1] and its arguments, including the zeroth,
+// after that.  It sets the limits given by spec and execs the script, or
+// writes why it couldn't to the exec status pipe and exits.  Each limit is
+// set as both the soft and hard limit, except that the hard CPU limit is a
+// second later, so that the script is killed by SIGXCPU rather than SIGKILL
+// and cpuLimitExceeded can tell.  It never returns.
+func execLimited(spec string) {
+	var memory, files, cpu uint64
+	var fd int
+	status := os.Stderr
+	fail := func(format string, args ...interface{}) {
+		fmt.Fprintf(status, format, args...)
+		os.Exit(127)
+	}
+	if _, err := fmt.Sscanf(spec, "%d,%d,%d,%d", &memory, &files, &cpu, &fd); err != nil || len(os.Args) < 3 {
+		fail("invalid %s=%q or arguments %q", rlimitsEnv, spec, os.Args)
+	}
+	status = os.NewFile(uintptr(fd), "exec status")
+	syscall.CloseOnExec(fd)
+	os.Unsetenv(rlimitsEnv)
+
+	// Everything exec needs is allocated beforehand.
+	path, err := syscall.BytePtrFromString(os.Args[1])
+	if err != nil {
+		fail("invalid script path: %v", err)
+	}
+	argv, err := syscall.SlicePtrFromStrings(os.Args[2:])
+	if err != nil {
+		fail("invalid script arguments: %v", err)
+	}
+	envv, err := syscall.SlicePtrFromStrings(os.Environ())
+	if err != nil {
+		fail("invalid environment: %v", err)
+	}
+
+	for _, l := range []struct {
+		resource int
+		value    uint64
+		extra    uint64
+		name     string
+	}{
+		{syscall.RLIMIT_NOFILE, files, 0, "file_limit"},
+		{syscall.RLIMIT_CPU, cpu, 1, "cpu_limit"},
+	} {
+		if l.value == 0 {
+			continue
+		}
+		rl := syscall.Rlimit{Cur: l.value, Max: l.value + l.extra}
+		if err := syscall.Setrlimit(l.resource, &rl); err != nil {
+			fail("unable to set %s: %v", l.name, err)
+		}
+	}
+
+	// Once the memory limit is set the Go runtime may be unable to map
+	// memory, which is fatal, and lowering the hard limit can't be undone.
+	// So from then on nothing is allocated: the garbage collector, which
+	// could otherwise start up on another thread, is turned off first, and
+	// setting the limit, exec, and reporting and exiting if exec fails are
+	// all raw system calls.
+	prefix := []byte(fmt.Sprintf("unable to run %s: ", os.Args[1]))
+	debug.SetGCPercent(-1)
+	if memory != 0 {
+		rl := syscall.Rlimit{Cur: memory, Max: memory}
+		if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, 0, syscall.RLIMIT_AS,
+			uintptr(unsafe.Pointer(&rl)), 0, 0, 0); errno != 0 {
+			fail("unable to set memory_limit: %v", errno)
+		}
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_EXECVE, uintptr(unsafe.Pointer(path)),
+		uintptr(unsafe.Pointer(&argv[0])), uintptr(unsafe.Pointer(&envv[0])))
+	// Errno.Error returns one of a table of constant strings.
+	msg := errno.Error()
+	msgData := (*reflect.StringHeader)(unsafe.Pointer(&msg)).Data
+	syscall.RawSyscall(syscall.SYS_WRITE, uintptr(fd), uintptr(unsafe.Pointer(&prefix[0])), uintptr(len(prefix)))
+	syscall.RawSyscall(syscall.SYS_WRITE, uintptr(fd), msgData, uintptr(len(msg)))
+	syscall.RawSyscall(syscall.SYS_EXIT_GROUP, 127, 0, 0)
+}
+
+// cpuLimitExceeded returns true if ee says the script was killed by the
+// SIGXCPU sent on reaching its CPU time limit.
+func cpuLimitExceeded(ee *exec.ExitError) bool {
+	ws, ok := ee.Sys().(syscall.WaitStatus)
+	return ok && ws.Signaled() && ws.Signal() == syscall.SIGXCPU
+}
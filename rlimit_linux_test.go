@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s MySuite) TestRunCommandRlimits(c *C) {
+	// The limits are in place before the script starts, so they apply to
+	// anything it spawns straight away too.
+	out, err := runCommand(context.Background(), commandOpts{limits: rlimits{files: 64, memory: 1 << 30}},
+		"sh", "-c", "sh -c 'ulimit -n; ulimit -v' & wait; echo \"$0 $1 ${SCRIPT_EXPORTER_RLIMITS-unset}\"", "zero", "one")
+	c.Assert(err, IsNil)
+	c.Check(out, Equals, "64\n1048576\nzero one unset\n")
+
+	// A script that can't be run is a spawn error, as it is without limits.
+	dir := writeScripts(c, map[string]string{"notexec": "#!/bin/sh\necho 'a 1'\n"})
+	defer os.RemoveAll(dir)
+	c.Assert(os.Chmod(path.Join(dir, "notexec"), 0644), IsNil)
+	for _, script := range []string{"no-such-script-here", "./no/such/script", path.Join(dir, "notexec")} {
+		_, err = runCommand(context.Background(), commandOpts{limits: rlimits{files: 64}}, script)
+		c.Check(err, FitsTypeOf, spawnError{}, Commentf("%s", script))
+		c.Check(err, ErrorMatches, "failed to start child: .*", Commentf("%s", script))
+	}
+
+	// A memory limit well below what the exporter itself has mapped only
+	// applies to the script.
+	out, err = runCommand(context.Background(), commandOpts{limits: rlimits{memory: 16 << 20}}, "sh", "-c", "ulimit -v")
+	c.Assert(err, IsNil)
+	c.Check(out, Equals, "16384\n")
+	// With one too small to run the script at all, either the exec fails or
+	// the kernel kills the new process image, rather than the Go runtime
+	// dying with a fatal error.
+	_, err = runCommand(context.Background(), commandOpts{limits: rlimits{memory: 64 << 10}}, "sh", "-c", "ulimit -v")
+	c.Check(err, ErrorMatches, "failed to start child: .*|signal: .*")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = runCommand(ctx, commandOpts{limits: rlimits{cpu: time.Second}}, "sh", "-c", "while :; do :; done")
+	c.Check(err, FitsTypeOf, limitError{})
+	c.Check(err, ErrorMatches, "exceeded cpu_limit of 1s")
+
+	c.Check(rlimits{cpu: 1500 * time.Millisecond}.cpuSeconds(), Equals, uint64(2))
+}
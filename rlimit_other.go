@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// limitCommand fails if any limit is given, since they're only supported on
+// Linux.
+func limitCommand(cmd *exec.Cmd, limits rlimits) (func() error, error) {
+	if limits == (rlimits{}) {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("setting script resource limits is only supported on linux")
+}
+
+// cpuLimitExceeded always returns false, as CPU limits can't be set.
+func cpuLimitExceeded(ee *exec.ExitError) bool {
+	return false
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// textfileHandler returns a handler which serves the metrics in every *.prom
+// file in dir, like node_exporter's textfile collector.  A file which can't
+// be read or parsed is reported by script_textfile_scrape_error and left out,
+// without failing the request.
+func textfileHandler(dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			errorf("error reading textfile directory '%s': %v", dir, err)
+			http.Error(w, "error reading textfile directory", http.StatusInternalServerError)
+			return
+		}
+
+		var errorMetrics []prometheus.Metric
+		all := prometheus.Gatherers{}
+		for _, fi := range files {
+			if !fi.Mode().IsRegular() || !strings.HasSuffix(fi.Name(), ".prom") {
+				continue
+			}
+			failed := 0.0
+			gatherer, err := readTextfile(filepath.Join(dir, fi.Name()))
+			if err != nil {
+				errorf("error reading textfile '%s': %v", fi.Name(), err)
+				failed = 1
+			} else {
+				all = append(all, gatherer)
+			}
+			errorMetrics = append(errorMetrics,
+				prometheus.MustNewConstMetric(textfileErrorDesc, prometheus.GaugeValue, failed, fi.Name()))
+		}
+		if len(errorMetrics) > 0 {
+			all = append(all, constGatherer(errorMetrics...))
+		}
+
+		handler := promhttp.HandlerFor(all, promhttp.HandlerOpts{
+			ErrorLog:      log.New(os.Stderr, "", log.LstdFlags),
+			ErrorHandling: promhttp.ContinueOnError,
+		})
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// readTextfile returns a Gatherer yielding the metrics in filename, which is
+// in the Prometheus text format.
+func readTextfile(filename string) (prometheus.Gatherer, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	gatherer, _, err := gathererFromText(parseOpts{}, string(content))
+	return gatherer, err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s MySuite) TestTextfileHandler(c *C) {
+	dir, err := ioutil.TempDir("", "script-exporter")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"a.prom":     "# TYPE a counter\na_total 1\nshared{f=\"a\"} 1\n",
+		"b.prom":     "shared{f=\"b\"} 2\n",
+		"bad.prom":   "not valid{\n",
+		"ignore.txt": "ignored 1\n",
+	} {
+		c.Assert(ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644), IsNil)
+	}
+
+	w := httptest.NewRecorder()
+	textfileHandler(dir).ServeHTTP(w, httptest.NewRequest("GET", "/textfile", nil))
+	c.Assert(w.Code, Equals, 200)
+	body := w.Body.String()
+	for _, line := range []string{
+		"a_total 1",
+		`shared{f="a"} 1`,
+		`shared{f="b"} 2`,
+		`script_textfile_scrape_error{file="a.prom"} 0`,
+		`script_textfile_scrape_error{file="bad.prom"} 1`,
+	} {
+		c.Check(strings.Contains(body, line+"\n"), Equals, true, Commentf("missing %q in %s", line, body))
+	}
+	c.Check(strings.Contains(body, "ignored"), Equals, false)
+
+	w = httptest.NewRecorder()
+	textfileHandler(path.Join(dir, "missing")).ServeHTTP(w, httptest.NewRequest("GET", "/textfile", nil))
+	c.Check(w.Code, Equals, 500)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// testCert is a certificate and key for tests.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert returns a certificate for cn, signed by parent, or self-signed
+// if parent is nil.
+func newTestCert(c *C, cn string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	c.Assert(err, IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write writes tc's certificate and key as PEM to files in dir named after
+// name, returning their paths.
+func (tc *testCert) write(c *C, dir, name string) (string, string) {
+	certFile, keyFile := path.Join(dir, name+".crt"), path.Join(dir, name+".key")
+	c.Assert(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.der}), 0644), IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(tc.key)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600), IsNil)
+	return certFile, keyFile
+}
+
+func (tc *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{tc.der}, PrivateKey: tc.key}
+}
+
+func (s MySuite) TestServerTLSConfig(c *C) {
+	dir, err := ioutil.TempDir("", "script-exporter")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(c, "ca", nil, true)
+	caFile, _ := ca.write(c, dir, "ca")
+	certFile, keyFile := newTestCert(c, "server", ca, false).write(c, dir, "server")
+	client := newTestCert(c, "scraper", ca, false)
+	other := newTestCert(c, "intruder", nil, false)
+
+	cfg, err := serverTLSConfig(certFile, keyFile, caFile)
+	c.Assert(err, IsNil)
+	c.Check(cfg.ClientAuth, Equals, tls.RequireAndVerifyClientCert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(clientCN(r)))
+	}))
+	srv.TLS = cfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(certs ...tls.Certificate) (string, error) {
+		cl := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		resp, err := cl.Get(srv.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	cn, err := get(client.tlsCert())
+	c.Assert(err, IsNil)
+	c.Check(cn, Equals, "scraper")
+	_, err = get()
+	c.Check(err, Not(IsNil))
+	_, err = get(other.tlsCert())
+	c.Check(err, Not(IsNil))
+
+	// Without a client CA, no client certificate is needed.
+	cfg, err = serverTLSConfig(certFile, keyFile, "")
+	c.Assert(err, IsNil)
+	c.Check(cfg.ClientAuth, Equals, tls.NoClientCert)
+
+	_, err = serverTLSConfig("", "", caFile)
+	c.Check(err, Not(IsNil))
+	_, err = serverTLSConfig(certFile, keyFile, keyFile)
+	c.Check(err, Not(IsNil))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// scriptFileState is what a scriptWatcher compares to tell whether a script
+// has changed.
+type scriptFileState struct {
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+}
+
+// A scriptWatcher polls a directory for scripts being added, removed or
+// changed.  fsnotify would save the polling, but isn't among our
+// dependencies, and polling also works on network filesystems.
+type scriptWatcher struct {
+	dir string
+
+	// onChange, if non-nil, is called with the names of the scripts which
+	// have changed, relative to dir, after every poll finding any.
+	onChange func(scripts []string)
+
+	// files holds the state of each script as of the latest poll, or is
+	// nil before the first.
+	files map[string]scriptFileState
+}
+
+// scanScripts returns the state of every executable file under dir, by path
+// relative to dir.  If dir is itself a file, it's keyed by its base name.
+func scanScripts(dir string) (map[string]scriptFileState, error) {
+	files := make(map[string]scriptFileState)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			return nil
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			name = filepath.Base(path)
+		}
+		files[filepath.ToSlash(name)] = scriptFileState{modTime: info.ModTime(), size: info.Size(), mode: info.Mode()}
+		return nil
+	})
+	return files, err
+}
+
+// poll scans sw.dir, updating script_files and counting scripts added,
+// removed or changed since the previous poll in script_files_changed_total.
+// It returns their names, sorted.  The first poll only records the scripts
+// found.
+func (sw *scriptWatcher) poll() ([]string, error) {
+	files, err := scanScripts(sw.dir)
+	if err != nil {
+		return nil, err
+	}
+	mScriptFiles.Set(float64(len(files)))
+	first := sw.files == nil
+	var changed []string
+	for name, state := range files {
+		if old, ok := sw.files[name]; !first && (!ok || old != state) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range sw.files {
+		if _, ok := files[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sw.files = files
+	sort.Strings(changed)
+	mFilesChanged.Add(float64(len(changed)))
+	return changed, nil
+}
+
+// run polls every interval, for ever.
+func (sw *scriptWatcher) run(interval time.Duration) {
+	for {
+		changed, err := sw.poll()
+		if err != nil {
+			warnf("Error checking scripts in '%s' for changes: %v", sw.dir, err)
+		} else if len(changed) > 0 {
+			infof("Scripts in '%s' changed: %v", sw.dir, changed)
+			if sw.onChange != nil {
+				sw.onChange(changed)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// forgetFailures resets the circuit breakers of scripts, so that they're run
+// again on the next request rather than being answered with a cached
+// failure.
+func (sh *ScriptHandler) forgetFailures(scripts []string) {
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+	for _, script := range scripts {
+		delete(sh.breakers, script)
+	}
+}
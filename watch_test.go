@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	. "gopkg.in/check.v1"
+)
+
+func (s MySuite) TestScriptWatcher(c *C) {
+	dir := writeScripts(c, map[string]string{
+		"one": "#!/bin/sh\necho 'a 1'\n",
+		"two": "#!/bin/sh\necho 'b 1'\n",
+	})
+	defer os.RemoveAll(dir)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "notes.txt"), []byte("not a script\n"), 0644), IsNil)
+
+	var m dto.Metric
+	changedTotal := func() float64 {
+		c.Assert(mFilesChanged.Write(&m), IsNil)
+		return m.GetCounter().GetValue()
+	}
+	before := changedTotal()
+
+	sw := &scriptWatcher{dir: dir}
+	changed, err := sw.poll()
+	c.Assert(err, IsNil)
+	c.Check(changed, HasLen, 0)
+	c.Assert(mScriptFiles.Write(&m), IsNil)
+	c.Check(m.GetGauge().GetValue(), Equals, 2.0)
+
+	// Modify one script, remove the other and add a third.
+	c.Assert(ioutil.WriteFile(path.Join(dir, "one"), []byte("#!/bin/sh\necho 'a 2'\n"), 0755), IsNil)
+	c.Assert(os.Chtimes(path.Join(dir, "one"), time.Now(), time.Now().Add(time.Minute)), IsNil)
+	c.Assert(os.Remove(path.Join(dir, "two")), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(dir, "three"), []byte("#!/bin/sh\n"), 0755), IsNil)
+	changed, err = sw.poll()
+	c.Assert(err, IsNil)
+	c.Check(changed, DeepEquals, []string{"one", "three", "two"})
+	c.Check(changedTotal()-before, Equals, 3.0)
+
+	changed, err = sw.poll()
+	c.Assert(err, IsNil)
+	c.Check(changed, HasLen, 0)
+}
+
+func (s MySuite) TestForgetFailures(c *C) {
+	sh := NewScriptHandler("/metrics", "/nonexistent", parseOpts{}, 1, 5*time.Second, ScriptConfig{}, nil)
+	sh.breakers["broken"] = &breaker{failures: 5, openUntil: time.Now().Add(time.Hour)}
+	sh.breakers["other"] = &breaker{failures: 5, openUntil: time.Now().Add(time.Hour)}
+	sh.forgetFailures([]string{"broken"})
+	_, open := sh.circuitOpen("broken", ScriptConfig{CircuitBreakerFailures: 3})
+	c.Check(open, Equals, false)
+	_, open = sh.circuitOpen("other", ScriptConfig{CircuitBreakerFailures: 3})
+	c.Check(open, Equals, true)
+}